@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+/*
+ * Connection tunneled through a proxy. Reads go through the buffered
+ * reader used to parse the proxy response, since Varnish may already
+ * have sent its banner by the time we have read the response headers.
+ */
+type proxyConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+/*
+ * Address of the proxy to connect to. Only plain HTTP proxies are
+ * supported, so the port defaults to 80.
+ */
+func proxyAddress(proxyURL *url.URL) (string, error) {
+	if proxyURL.Scheme != "http" {
+		return "", fmt.Errorf("Unsupported proxy scheme %q, only http is supported", proxyURL.Scheme)
+	}
+	if proxyURL.Hostname() == "" {
+		return "", fmt.Errorf("No host in proxy URL")
+	}
+	port := proxyURL.Port()
+	if port == "" {
+		port = "80"
+	}
+	return net.JoinHostPort(proxyURL.Hostname(), port), nil
+}
+
+/*
+ * Open a tunnel to addr through an HTTP proxy using CONNECT. The timeout
+ * covers both connecting to the proxy and its response, 0 for none.
+ */
+func dialProxy(proxyURL *url.URL, addr string, timeout time.Duration) (net.Conn, error) {
+	proxyAddr, err := proxyAddress(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", proxyAddr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("Proxy returned %s", resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return &proxyConn{Conn: conn, r: r}, nil
+}
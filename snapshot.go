@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/* The latest parsed state of the backends, for the JSON snapshot */
+type snapshot struct {
+	Timestamp time.Time                 `json:"timestamp"`
+	Counts    map[string]int            `json:"counts"`
+	Directors map[string]map[string]int `json:"directors,omitempty"`
+	Backends  map[string]string         `json:"backends"`
+}
+
+var lastSnapshot *snapshot
+var snapshotMutex sync.Mutex
+
+/*
+ * Store the result of a check. counts is per director and state, with
+ * director "" when not in director mode, and backends maps backend name
+ * to state.
+ */
+func storeSnapshot(counts map[string]map[string]int, backends map[string]string) {
+	s := &snapshot{
+		Timestamp: time.Now(),
+		Counts:    make(map[string]int),
+		Backends:  backends,
+	}
+	for _, c := range counts {
+		for state, n := range c {
+			s.Counts[state] += n
+		}
+	}
+	if extractDirector != nil {
+		s.Directors = counts
+	}
+
+	snapshotMutex.Lock()
+	lastSnapshot = s
+	snapshotMutex.Unlock()
+}
+
+/*
+ * Log every backend that is in a different state than in the previous
+ * snapshot, in logfmt, for a change log that doesn't need Prometheus.
+ */
+func logStateTransitions(backends map[string]string) {
+	snapshotMutex.Lock()
+	s := lastSnapshot
+	snapshotMutex.Unlock()
+
+	if s == nil {
+		return
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	for name, state := range backends {
+		if old, ok := s.Backends[name]; ok && old != state {
+			fmt.Printf("ts=%s event=transition backend=%q old_state=%s new_state=%s\n", now, name, old, state)
+		}
+	}
+}
+
+/* Handler returning the latest state as JSON */
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	snapshotMutex.Lock()
+	s := lastSnapshot
+	snapshotMutex.Unlock()
+
+	if s == nil {
+		http.Error(w, "No successful check yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/* SSH server to tunnel the connection to Varnish through */
+type sshTunnel struct {
+	addr    string
+	config  *ssh.ClientConfig
+	timeout time.Duration
+}
+
+/*
+ * Set up tunneling through an SSH server given as [user@]host[:port],
+ * authenticating with the private key in keyFile. The host key of the
+ * server is always verified against knownHostsFile, by default the
+ * known_hosts file of the user running the exporter.
+ */
+func newSSHTunnel(target string, keyFile string, knownHostsFile string, timeout time.Duration) (*sshTunnel, error) {
+	var username string
+	host := target
+	if i := strings.LastIndex(target, "@"); i >= 0 {
+		username, host = target[:i], target[i+1:]
+	} else {
+		u, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("No SSH user given, and could not get the current user: %w", err)
+		}
+		username = u.Username
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = hostPort(host, 22)
+	}
+
+	if keyFile == "" {
+		return nil, fmt.Errorf("No SSH key given")
+	}
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse SSH key %s: %w", keyFile, err)
+	}
+
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeys, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sshTunnel{
+		addr: host,
+		config: &ssh.ClientConfig{
+			User:            username,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeys,
+			Timeout:         timeout,
+		},
+		timeout: timeout,
+	}, nil
+}
+
+/*
+ * Connect to the SSH server and open a tunnel to addr through it. The
+ * timeout covers connecting, the SSH handshake and opening the tunnel.
+ * Each tunnel gets an SSH connection of its own, closed along with it.
+ */
+func (t *sshTunnel) dial(addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", t.addr, t.timeout)
+	if err != nil {
+		return nil, err
+	}
+	if t.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(t.timeout))
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, t.addr, t.config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SSH connection to %s failed: %w", t.addr, err)
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	tunnel, err := client.Dial("tcp", addr)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("SSH tunnel to %s failed: %w", addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return &sshConn{Conn: tunnel, client: client}, nil
+}
+
+/*
+ * Connection tunneled through SSH. SSH channels don't support deadlines,
+ * so a read deadline is emulated by closing the connection if it passes
+ * while reading. The deadline can't be set on the underlying connection,
+ * since the SSH client keeps reading from it also between commands.
+ */
+type sshConn struct {
+	net.Conn
+	client   *ssh.Client
+	deadline time.Time
+}
+
+func (c *sshConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *sshConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *sshConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *sshConn) Read(b []byte) (int, error) {
+	if c.deadline.IsZero() {
+		return c.Conn.Read(b)
+	}
+	wait := time.Until(c.deadline)
+	if wait <= 0 {
+		return 0, os.ErrDeadlineExceeded
+	}
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(wait, func() {
+		timedOut.Store(true)
+		c.Close()
+	})
+	n, err := c.Conn.Read(b)
+	timer.Stop()
+	if err != nil && timedOut.Load() {
+		/* Reported as a timeout, like on a regular connection */
+		err = os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+func (c *sshConn) Close() error {
+	err := c.Conn.Close()
+	c.client.Close()
+	return err
+}
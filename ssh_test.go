@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+/*
+ * Varnish management interface that authenticates with the given secret
+ * and answers ping, and never answers sleep.
+ */
+func fakeVarnish(t testing.TB, secret string) string {
+	const challenge = "abcdefghijklmnopqrstuvwxyzabcdef"
+	return listen(t, func(conn net.Conn) {
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		banner := challenge + "\n\nAuthentication required.\n"
+		io.WriteString(conn, responseHeader(107, banner)+banner+"\n")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch cmd := strings.Fields(line); {
+			case len(cmd) == 2 && cmd[0] == "auth" && cmd[1] == authResponse(challenge, []byte(secret)):
+				io.WriteString(conn, responseHeader(200, "Welcome")+"Welcome\n")
+			case len(cmd) == 2 && cmd[0] == "auth":
+				/* Like Varnish 4 and later, a wrong secret closes the connection */
+				io.WriteString(conn, responseHeader(500, "Closing CLI connection")+"Closing CLI connection\n")
+				return
+			case len(cmd) == 1 && cmd[0] == "ping":
+				io.WriteString(conn, responseHeader(200, "PONG")+"PONG\n")
+			case len(cmd) == 1 && cmd[0] == "sleep":
+			default:
+				io.WriteString(conn, responseHeader(101, "Unknown request")+"Unknown request\n")
+			}
+		}
+	})
+}
+
+/*
+ * SSH server accepting the user with the client key, which forwards
+ * direct-tcpip channels like sshd does for ssh -L. Returns its address
+ * and a known hosts file with its host key.
+ */
+func sshServer(t testing.TB, username string, client ssh.PublicKey) (string, string) {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() != username || string(key.Marshal()) != string(client.Marshal()) {
+				return nil, errors.New("denied")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	addr := listen(t, func(conn net.Conn) {
+		_, chans, reqs, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		for nc := range chans {
+			var target struct {
+				Host       string
+				Port       uint32
+				OriginHost string
+				OriginPort uint32
+			}
+			if nc.ChannelType() != "direct-tcpip" || ssh.Unmarshal(nc.ExtraData(), &target) != nil {
+				nc.Reject(ssh.UnknownChannelType, "not supported")
+				continue
+			}
+			remote, err := net.Dial("tcp", hostPort(target.Host, int(target.Port)))
+			if err != nil {
+				nc.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			ch, chreqs, err := nc.Accept()
+			if err != nil {
+				remote.Close()
+				continue
+			}
+			go ssh.DiscardRequests(chreqs)
+			go func() {
+				io.Copy(ch, remote)
+				ch.Close()
+			}()
+			go func() {
+				io.Copy(remote, ch)
+				remote.Close()
+			}()
+		}
+	})
+
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, signer.PublicKey())
+	if err := ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return addr, knownHosts
+}
+
+/* Write a new private key in OpenSSH format, returning the file and its public key */
+func sshKey(t testing.TB) (string, ssh.PublicKey) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file, sshPub
+}
+
+func TestSSHTunnel(t *testing.T) {
+	keyFile, pub := sshKey(t)
+	server, knownHosts := sshServer(t, "varnish", pub)
+	varnish := fakeVarnish(t, "secret\n")
+
+	tunnel, err := newSSHTunnel("varnish@"+server, keyFile, knownHosts, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vadm, err := connectVarnish(func() (net.Conn, error) { return tunnel.dial(varnish) }, []byte("secret\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vadm.Close()
+	if code, resp, err := vadm.Command("ping"); err != nil || code != 200 || resp != "PONG" {
+		t.Fatalf("ping through the tunnel gave %d %q %v", code, resp, err)
+	}
+
+	/* The emulated read deadline gives up on a command that is never answered */
+	vadm.timeout = 200 * time.Millisecond
+	start := time.Now()
+	if _, _, err := vadm.Command("sleep"); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Got %v, want a timeout", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Took %s to time out", time.Since(start))
+	}
+}
+
+func TestSSHTunnelRejected(t *testing.T) {
+	keyFile, pub := sshKey(t)
+	server, knownHosts := sshServer(t, "varnish", pub)
+	varnish := fakeVarnish(t, "secret\n")
+
+	/* A server whose host key isn't known */
+	_, otherHosts := sshServer(t, "varnish", pub)
+	tunnel, err := newSSHTunnel("varnish@"+server, keyFile, otherHosts, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keyErr *knownhosts.KeyError
+	if _, err := tunnel.dial(varnish); !errors.As(err, &keyErr) {
+		t.Errorf("Got %v, want an unknown host key", err)
+	}
+
+	/* A user the server doesn't accept */
+	tunnel, err = newSSHTunnel("other@"+server, keyFile, knownHosts, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tunnel.dial(varnish); err == nil || !strings.Contains(err.Error(), "unable to authenticate") {
+		t.Errorf("Got %v, want an authentication failure", err)
+	}
+}
+
+/* Without a user, the one running the exporter is used */
+func TestSSHTunnelUser(t *testing.T) {
+	keyFile, _ := sshKey(t)
+	tunnel, err := newSSHTunnel("bastion.example.com", keyFile, os.DevNull, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tunnel.config.User != u.Username || tunnel.addr != "bastion.example.com:22" {
+		t.Errorf("Got %s@%s, want %s@bastion.example.com:22", tunnel.config.User, tunnel.addr, u.Username)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+)
+
+/* Keep packets below the usual MTU to avoid fragmentation */
+const statsdMaxPacket = 1400
+
+/* Minimal statsd client, sending gauges over UDP */
+type statsdClient struct {
+	conn   net.Conn
+	prefix string
+}
+
+func newStatsdClient(address string, prefix string) (*statsdClient, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdClient{conn: conn, prefix: prefix}, nil
+}
+
+/* Characters that have a meaning in statsd metric names */
+var statsdReplacer = strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_", " ", "_")
+
+/*
+ * Send the number of backends in each state as gauges, as
+ * <prefix>backends.<state> and, in director mode, also as
+ * <prefix>director.<director>.<state>.
+ */
+func (c *statsdClient) sendCounts(counts map[string]map[string]int) error {
+	var lines []string
+	totals := make(map[string]int)
+	for director, dc := range counts {
+		for _, state := range append(backendStates(), "total") {
+			totals[state] += dc[state]
+			if extractDirector != nil {
+				lines = append(lines, fmt.Sprintf("%sdirector.%s.%s:%d|g\n", c.prefix, statsdReplacer.Replace(director), state, dc[state]))
+			}
+		}
+	}
+	for _, state := range append(backendStates(), "total") {
+		lines = append(lines, fmt.Sprintf("%sbackends.%s:%d|g\n", c.prefix, state, totals[state]))
+	}
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+len(line) > statsdMaxPacket {
+			if _, err := c.conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		buf.WriteString(line)
+	}
+	_, err := c.conn.Write(buf.Bytes())
+	return err
+}
@@ -2,184 +2,2742 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/version"
+	"hash"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+/*
+ * All reads go through the same buffered reader, so that no bytes
+ * buffered while reading the header are lost when reading the body.
+ */
 type VarnishWrapper struct {
 	conn net.Conn
+	r    *bufio.Reader
+	/* Deadline for each command and its response, 0 for none */
+	timeout time.Duration
+	/* Why the last response could not be read, nil if it could */
+	err error
+	/* Number of commands sent, reset by the caller */
+	commands int
+	/* Buffer for response bodies, reused between commands */
+	buf []byte
+}
+
+func newVarnishWrapper(conn net.Conn) *VarnishWrapper {
+	return &VarnishWrapper{conn: conn, r: bufio.NewReader(conn)}
+}
+
+/*
+ * Read the header line of a response. An empty line is skipped, since
+ * the trailing newline of the previous body may arrive late.
+ */
+func (v *VarnishWrapper) readHeader() (string, error) {
+	for {
+		line, err := v.r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line != "" {
+			return line, nil
+		}
+	}
 }
 
 func (v *VarnishWrapper) ReadResponse() (code int, response *string) {
 	var status, length int
+	v.err = nil
+
+	header, err := v.readHeader()
+	if err != nil {
+		fmt.Printf("Failed to read header: %s\n", err)
+		v.err = err
+		return -1, nil
+	}
+
+	headers, err := fmt.Sscanf(header, "%03d %8d", &status, &length)
+	if err != nil {
+		fmt.Printf("Failed to scan header: %s\n", err)
+		v.err = fmt.Errorf("Invalid header %q: %w", header, err)
+		return -1, nil
+	}
+
+	if headers != 2 {
+		fmt.Printf("Invalid number of headers: %d\n", headers)
+		v.err = fmt.Errorf("Invalid header %q", header)
+		return -1, nil
+	}
+
+	/* Don't allocate whatever a corrupt header claims */
+	if length < 0 || length > *maxResponseSize {
+		fmt.Printf("Invalid response length: %d\n", length)
+		v.err = fmt.Errorf("Invalid response length %d in header %q, the limit is %d", length, header, *maxResponseSize)
+		return -1, nil
+	}
+
+	/*
+	 * The body is normally followed by a newline that is not included
+	 * in the length, but not all versions send it, so accept both.
+	 */
+	var buf []byte
+	if length <= *readBufferSize {
+		/* Reused, since the body is copied into a string below */
+		if cap(v.buf) < length {
+			v.buf = make([]byte, length)
+		}
+		buf = v.buf[:length]
+	} else {
+		/* Don't keep an occasional huge response around */
+		buf = make([]byte, length)
+	}
+	_, err = io.ReadFull(v.r, buf)
+	if err != nil {
+		fmt.Printf("Read from Varnish failed: %s\n", err)
+		v.err = err
+		return -1, nil
+	}
+
+	if v.r.Buffered() > 0 {
+		if next, _ := v.r.Peek(1); next[0] != '\n' {
+			fmt.Printf("Expected newline after %d bytes of response\n", length)
+			v.err = fmt.Errorf("Expected newline after %d bytes of response", length)
+			return -1, nil
+		}
+		v.r.Discard(1)
+	}
+
+	ret := string(buf)
+	return status, &ret
+}
+
+func (v *VarnishWrapper) Send(str string, args ...string) error {
+	var buf = append([]string{str}, args...)
+	body := fmt.Sprintf("%s\n", strings.Join(buf, " "))
+	v.commands++
+	if v.timeout > 0 {
+		v.conn.SetDeadline(time.Now().Add(v.timeout))
+	}
+	_, err := v.conn.Write([]byte(body))
+	if err != nil {
+		fmt.Printf("Write error: %s\n", err)
+		return err
+	}
+	return nil
+}
+
+/* Send a command and return both the status code and the response body */
+func (v *VarnishWrapper) Command(cmd string, args ...string) (int, string, error) {
+	err := v.Send(cmd, args...)
+	if err != nil {
+		return -1, "", err
+	}
+	code, resp := v.ReadResponse()
+	if resp == nil {
+		return code, "", fmt.Errorf("Failed to read response to %s: %w", cmd, v.err)
+	}
+	return code, *resp, nil
+}
+
+func (v *VarnishWrapper) CommandForSuccess(cmd string, args ...string) bool {
+	code, _, err := v.Command(cmd, args...)
+	return (err == nil && code == 200)
+}
+
+func (v *VarnishWrapper) Close() error {
+	return v.conn.Close()
+}
+
+/* Connection that keeps track of the number of bytes read and written */
+type countingConn struct {
+	net.Conn
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	promreadbytes.Add(float64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	promwritebytes.Add(float64(n))
+	return n, err
+}
+
+/*
+ * Error from checking Varnish, with the phase of the check it happened
+ * in: dial, auth, command, timeout or deadline.
+ */
+type ScrapeError struct {
+	Phase string
+	Err   error
+}
+
+func (e *ScrapeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ScrapeError) Unwrap() error {
+	return e.Err
+}
+
+/* Create a ScrapeError, using the timeout phase for any timeout */
+func newScrapeError(phase string, err error) *ScrapeError {
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		phase = "timeout"
+	}
+	return &ScrapeError{Phase: phase, Err: err}
+}
+
+/* Function used to open a new connection to the management interface */
+type dialFunc func() (net.Conn, error)
+
+/*
+ * Deadline for a whole check cycle, from connecting to parsing the
+ * backend list. When it passes, the connection is closed underneath
+ * whatever is blocked on it, so the cycle is abandoned right away.
+ */
+type cycleDeadline struct {
+	mutex  sync.Mutex
+	conn   net.Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+/* Start the deadline, unless it's disabled or already running */
+func (d *cycleDeadline) start(timeout time.Duration) {
+	if timeout <= 0 || d.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	context.AfterFunc(ctx, func() {
+		if ctx.Err() != context.DeadlineExceeded {
+			return
+		}
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		if d.conn != nil {
+			d.conn.Close()
+		}
+	})
+	d.ctx, d.cancel = ctx, cancel
+}
+
+func (d *cycleDeadline) exceeded() bool {
+	return d.ctx != nil && d.ctx.Err() == context.DeadlineExceeded
+}
+
+/* Stop the deadline, returning whether it had been exceeded */
+func (d *cycleDeadline) stop() bool {
+	if d.cancel == nil {
+		return false
+	}
+	exceeded := d.exceeded()
+	d.cancel()
+	d.ctx, d.cancel = nil, nil
+	return exceeded
+}
+
+/* Wrap a dialFunc to keep track of the connection to close */
+func (d *cycleDeadline) dial(dial dialFunc) dialFunc {
+	return func() (net.Conn, error) {
+		conn, err := dial()
+		if err != nil {
+			return nil, err
+		}
+		if d.exceeded() {
+			conn.Close()
+			return nil, d.ctx.Err()
+		}
+		d.mutex.Lock()
+		d.conn = conn
+		d.mutex.Unlock()
+		return conn, nil
+	}
+}
+
+/*
+ * Address of a host and port to connect to. JoinHostPort adds brackets
+ * around IPv6 addresses, keeping any zone such as fe80::1%eth0, so the
+ * host is accepted both with and without them.
+ */
+func hostPort(host string, port int) string {
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), strconv.Itoa(port))
+}
+
+/*
+ * Connect directly to an address. Without a timeout, a blackholed port
+ * can take minutes to fail.
+ */
+func directDial(addr string, timeout time.Duration) dialFunc {
+	dialer := &net.Dialer{Timeout: timeout}
+	return func() (net.Conn, error) {
+		return dialer.Dial("tcp", addr)
+	}
+}
+
+/* Connect to the Varnish management interface and authenticate */
+func connectVarnish(dial dialFunc, secret []byte) (*VarnishWrapper, error) {
+	conn, err := dial()
+	if err != nil {
+		return nil, newScrapeError("dial", fmt.Errorf("Connection failed: %w", err))
+	}
+	conn = &countingConn{conn}
+	/* Authentication must complete within the connect timeout */
+	if *connectTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(time.Duration(*connectTimeout) * time.Second))
+	}
+	vadm := newVarnishWrapper(conn)
+	code, resp := vadm.ReadResponse()
+	if code == -1 {
+		conn.Close()
+		if vadm.err != io.EOF {
+			return nil, newScrapeError("dial", fmt.Errorf("Connection failed: %w", vadm.err))
+		}
+		/*
+		 * Typically a firewall or proxy that accepts the connection and
+		 * then closes it. Treat as a failed connection, so that it goes
+		 * through the normal reconnect delay.
+		 */
+		return nil, newScrapeError("dial", fmt.Errorf("Connection failed: closed before authentication prompt"))
+	}
+	if code != 107 {
+		promauthfailures.WithLabelValues("no_challenge").Inc()
+		conn.Close()
+		return nil, newScrapeError("auth", fmt.Errorf("Varnish did not give authentication prompt, got code %d: %s", code, responseText(resp)))
+	}
+	challenge := strings.Split(*resp, "\n")[0]
+	if !validChallenge(challenge) {
+		/* Typically a truncated banner, the response would be computed over garbage */
+		Debug(fmt.Sprintf("Malformed authentication challenge in banner: %q", *resp))
+		promauthfailures.WithLabelValues("malformed_challenge").Inc()
+		conn.Close()
+		return nil, newScrapeError("auth", fmt.Errorf("Varnish sent a malformed authentication challenge"))
+	}
+	err = vadm.Send("auth", authResponse(challenge, secret))
+	if err != nil {
+		promauthfailures.WithLabelValues("error").Inc()
+		conn.Close()
+		return nil, newScrapeError("auth", fmt.Errorf("Failed to send authentication: %w", err))
+	}
+
+	code, resp = vadm.ReadResponse()
+	switch code {
+	case 200:
+		promauthsuccesses.Inc()
+		conn.SetDeadline(time.Time{})
+		vadm.timeout = time.Duration(*commandTimeout) * time.Second
+		return vadm, nil
+	case 107, 500:
+		/*
+		 * Varnish 4 and later close the connection on a wrong response,
+		 * with code 500 (CLIS_CLOSE), older versions send a new challenge.
+		 */
+		err = fmt.Errorf("Failed to authenticate, wrong secret")
+		promauthfailures.WithLabelValues("wrong_secret").Inc()
+	case 100, 101, 102, 104, 105, 106:
+		/* Syntax, unknown, unimplemented, too few, too many, bad parameter */
+		err = fmt.Errorf("Failed to authenticate, protocol error code %d: %s", code, responseText(resp))
+		promauthfailures.WithLabelValues("error").Inc()
+	default:
+		err = fmt.Errorf("Failed to authenticate, got code %d: %s", code, responseText(resp))
+		promauthfailures.WithLabelValues("error").Inc()
+	}
+	conn.Close()
+	return nil, newScrapeError("auth", err)
+}
+
+/* Varnish challenges are 32 lowercase letters */
+func validChallenge(challenge string) bool {
+	if len(challenge) != 32 {
+		return false
+	}
+	for _, c := range challenge {
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * Connect using each of the secrets in turn until one is accepted, so
+ * that both the old and the new secret work while rotating it. Since
+ * Varnish closes the connection on a wrong secret, each attempt uses a
+ * new connection.
+ */
+func connectVarnishSecrets(dial dialFunc, secrets [][]byte) (*VarnishWrapper, error) {
+	var err error
+	for i, secret := range secrets {
+		var vadm *VarnishWrapper
+		vadm, err = connectVarnish(dial, secret)
+		if err == nil {
+			Debug(fmt.Sprintf("Authenticated using secret %d", i+1))
+			return vadm, nil
+		}
+		var serr *ScrapeError
+		if !errors.As(err, &serr) || serr.Phase != "auth" {
+			break
+		}
+	}
+	return nil, err
+}
+
+/*
+ * Digests that can be used for authentication, selected with
+ * -varnish.auth-digest. Varnish currently only uses SHA-256.
+ */
+var authDigests = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+}
+var authDigest = sha256.New
+
+/*
+ * Compute the response to an authentication challenge the same way as
+ * varnishadm does: the digest of the challenge, a newline, the secret
+ * file exactly as stored (including any trailing newline), the challenge
+ * again and a final newline.
+ */
+func authResponse(challenge string, secret []byte) string {
+	h := authDigest()
+	h.Write([]byte(challenge))
+	h.Write([]byte("\n"))
+	h.Write(secret)
+	h.Write([]byte(challenge))
+	h.Write([]byte("\n"))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+/*
+ * The secret files, which can be re-read periodically to pick up a
+ * secret that has been rotated in place, such as a Kubernetes secret
+ * volume where the file is replaced by swapping a symlink. Each path is
+ * either a file or a directory, in which case all files in it are used.
+ * With a command set, the secret is instead the output of the command.
+ */
+type secretFiles struct {
+	paths []string
+	cmd   string
+	mutex sync.RWMutex
+	data  [][]byte
+	/* The files read, with directories expanded */
+	files []string
+}
+
+/*
+ * Run the secret command, such as a helper fetching the secret from a
+ * vault. Varnish uses the whole secret file, including any trailing
+ * newline, so the output is used as is, like the contents of a file.
+ */
+func commandSecret(cmd string) ([]byte, error) {
+	ctx := context.Background()
+	if *connectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(*connectTimeout)*time.Second)
+		defer cancel()
+	}
+	c := exec.CommandContext(ctx, "/bin/sh", "-c", cmd)
+	c.Stderr = os.Stderr
+	out, err := c.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Secret command failed: %w", err)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("Secret command returned no secret")
+	}
+	return out, nil
+}
+
+func (s *secretFiles) load() error {
+	if s.cmd != "" {
+		secret, err := commandSecret(s.cmd)
+		if err != nil {
+			return err
+		}
+		s.mutex.Lock()
+		s.data = [][]byte{secret}
+		s.mutex.Unlock()
+		return nil
+	}
+
+	var data [][]byte
+	var read []string
+	for _, path := range s.paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		files := []string{path}
+		if fi.IsDir() {
+			entries, err := ioutil.ReadDir(path)
+			if err != nil {
+				return err
+			}
+			files = nil
+			for _, e := range entries {
+				/* Skip hidden entries, like ..data in Kubernetes volumes */
+				if strings.HasPrefix(e.Name(), ".") {
+					continue
+				}
+				f := filepath.Join(path, e.Name())
+				if fi, err := os.Stat(f); err != nil || fi.IsDir() {
+					continue
+				}
+				files = append(files, f)
+			}
+		}
+		for _, f := range files {
+			secret, err := ioutil.ReadFile(f)
+			if err != nil {
+				return err
+			}
+			data = append(data, secret)
+			read = append(read, f)
+		}
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("No secret files found")
+	}
+	s.mutex.Lock()
+	s.data = data
+	s.files = read
+	s.mutex.Unlock()
+	return nil
+}
+
+func (s *secretFiles) get() [][]byte {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.data
+}
+
+/*
+ * Collector exporting the time since each secret file was modified, as
+ * of the time of the scrape, to alert on secrets that are not rotated.
+ */
+type secretAgeCollector struct {
+	secrets *secretFiles
+	desc    *prometheus.Desc
+}
+
+func newSecretAgeCollector(secrets *secretFiles) secretAgeCollector {
+	return secretAgeCollector{
+		secrets: secrets,
+		desc:    prometheus.NewDesc("varnish_backend_secret_age_seconds", "time since the varnish secret file was modified", []string{"file"}, nil),
+	}
+}
+
+func (c secretAgeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c secretAgeCollector) Collect(ch chan<- prometheus.Metric) {
+	c.secrets.mutex.RLock()
+	files := c.secrets.files
+	c.secrets.mutex.RUnlock()
+	for _, f := range files {
+		/* A file that has just been rotated away is simply left out */
+		fi, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, time.Since(fi.ModTime()).Seconds(), f)
+	}
+}
+
+/* Goroutine re-reading the secret files, keeping the old secrets on errors */
+func (s *secretFiles) reload(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := s.load(); err != nil {
+			fmt.Printf("Failed to re-read secrets, keeping previous ones: %s\n", err)
+		}
+	}
+}
+
+/* Response body suitable for logging, which may be missing on errors */
+func responseText(resp *string) string {
+	if resp == nil {
+		return "(no response)"
+	}
+	return strings.TrimSpace(*resp)
+}
+
+/* Prometheus counters */
+var prombackends *prometheus.GaugeVec
+var promunknownratio prometheus.Gauge
+var prombackendsperdirector prometheus.Histogram
+var promadmin *prometheus.GaugeVec
+var promadminnoport *prometheus.GaugeVec
+var prommatrix *prometheus.GaugeVec
+var promskippedlines prometheus.Gauge
+var promcurconns *prometheus.GaugeVec
+var promdirectorbackends *prometheus.GaugeVec
+var promallstates *prometheus.GaugeVec
+var promvclstates *prometheus.GaugeVec
+var promdirectorlastchange *prometheus.GaugeVec
+var promoverflow prometheus.Gauge
+var promreadbytes prometheus.Counter
+var promauthsuccesses prometheus.Counter
+var promauthfailures *prometheus.CounterVec
+var promwritebytes prometheus.Counter
+
+/* Label values of varnish_backend_admin for each backend */
+var lastAdminLabels = make(map[string][]string)
+
+/*
+ * State of each backend exported by -metric.style enum, and the backends
+ * with a current connections series, as of the last check. Cleared when
+ * series are removed outside of updateBackends, so they are all set again.
+ */
+var lastBackendStates = make(map[string]string)
+var lastCurConns = make(map[string]bool)
+
+var directorRegexps []*regexp.Regexp
+var directorMutex sync.RWMutex
+var extractDirector func(name string) string = nil
+var promlabels []string
+
+/* Flag that can be given multiple times, collecting all values */
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+/* Gatherer replacing the help text of some metrics */
+type helpGatherer struct {
+	prometheus.Gatherer
+	help map[string]string
+}
+
+func (g helpGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	for _, mf := range mfs {
+		if h, ok := g.help[mf.GetName()]; ok {
+			mf.Help = &h
+		}
+	}
+	return mfs, err
+}
+
+/*
+ * Held while the metrics are updated from a backend list, so that a
+ * scrape never sees them half updated, such as right after a Reset and
+ * before the new values have been set.
+ */
+var updateMutex sync.RWMutex
+
+/* Gatherer that waits for any update of the metrics in progress */
+type lockedGatherer struct {
+	prometheus.Gatherer
+}
+
+func (g lockedGatherer) Gather() ([]*dto.MetricFamily, error) {
+	updateMutex.RLock()
+	defer updateMutex.RUnlock()
+	return g.Gatherer.Gather()
+}
+
+/*
+ * Extract director name using the capture group in -directorre. If
+ * given multiple times, the first one that matches with a non-empty
+ * capture group is used.
+ */
+func regexpDirector(name string) string {
+	directorMutex.RLock()
+	defer directorMutex.RUnlock()
+	for _, r := range directorRegexps {
+		m := r.FindStringSubmatch(name)
+		if len(m) > 1 && m[1] != "" {
+			return m[1]
+		}
+	}
+	return "unknown"
+}
+
+/* Extract director name as the part before the first dot (vcl.backend) */
+func prefixDirector(name string) string {
+	i := strings.Index(name, ".")
+	if i > 0 {
+		return name[:i]
+	}
+	return "unknown"
+}
+
+/* Set once the first check of Varnish has completed successfully */
+var ready atomic.Bool
+
+/* Time the backend list was last parsed, in Unix nanoseconds */
+var lastCheck atomic.Int64
+
+/*
+ * Collector that adds the time of the last check as timestamp to all
+ * metrics of the collector it wraps.
+ */
+type timestampCollector struct {
+	prometheus.Collector
+}
+
+func (c timestampCollector) Collect(ch chan<- prometheus.Metric) {
+	t := lastCheck.Load()
+	if t == 0 {
+		c.Collector.Collect(ch)
+		return
+	}
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		c.Collector.Collect(metrics)
+		close(metrics)
+	}()
+	for m := range metrics {
+		ch <- prometheus.NewMetricWithTimestamp(time.Unix(0, t), m)
+	}
+}
+
+/*
+ * Collector for varnish_backend_admin with -backend.port-label, where
+ * backends with and without a port have different labels. It is left
+ * unchecked by not describing any metrics, since the registry otherwise
+ * requires the same labels for all series of a metric.
+ */
+type adminCollector struct {
+	port   *prometheus.GaugeVec
+	noport *prometheus.GaugeVec
+}
+
+func (c adminCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (c adminCollector) Collect(ch chan<- prometheus.Metric) {
+	c.port.Collect(ch)
+	c.noport.Collect(ch)
+}
+
+/* The varnish_backend_admin series with the given label values */
+func adminGauge(labels []string) *prometheus.GaugeVec {
+	if *portLabel && len(labels) == 2 {
+		return promadminnoport
+	}
+	return promadmin
+}
+
+/* Register a metric that is updated from the backend list */
+func registerBackendMetric(c prometheus.Collector) {
+	if *checkTimestamps {
+		c = timestampCollector{c}
+	}
+	prometheus.MustRegister(c)
+}
+
+/*
+ * Create and register the metrics updated from the backend list, and
+ * forget the series set by earlier checks.
+ */
+func registerBackendMetrics() {
+	switch *metricStyle {
+	case "count":
+		promlabels = []string{"state"}
+	case "enum":
+		promlabels = []string{"backend", "state"}
+	}
+	if extractDirector != nil {
+		promlabels = append(promlabels, "director")
+	}
+
+	prombackends = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "varnish_backend_state",
+			Help: "varnish backend states",
+		},
+		promlabels,
+	)
+	registerBackendMetric(prombackends)
+
+	if exportAdmin {
+		adminlabels := []string{"backend", "flag"}
+		if *portLabel {
+			adminlabels = append(adminlabels, "port")
+		}
+		promadmin = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "varnish_backend_admin",
+				Help: "varnish backend admin flag",
+			},
+			adminlabels,
+		)
+		if *portLabel {
+			/* Backends listed without a port get no port label, not an empty one */
+			promadminnoport = prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: "varnish_backend_admin",
+					Help: "varnish backend admin flag",
+				},
+				[]string{"backend", "flag"},
+			)
+			registerBackendMetric(adminCollector{promadmin, promadminnoport})
+		} else {
+			registerBackendMetric(promadmin)
+		}
+	}
+	promoverflow = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "varnish_backend_overflow",
+			Help: "varnish backends in the last backend list not exported per backend because of -backend.max",
+		},
+	)
+	prometheus.MustRegister(promoverflow)
+	if exportConnections {
+		promcurconns = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "varnish_backend_current_connections",
+				Help: "current connections to varnish backends, if listed by varnish",
+			},
+			[]string{"backend"},
+		)
+		registerBackendMetric(promcurconns)
+	}
+	promskippedlines = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "varnish_backend_parse_skipped_lines",
+			Help: "lines in the last backend list that were not backends or backend details",
+		},
+	)
+	prometheus.MustRegister(promskippedlines)
+	if *backendMatrix {
+		prommatrix = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "varnish_backend_matrix",
+				Help: "number of varnish backends by admin flag and probe result",
+			},
+			[]string{"admin", "probe"},
+		)
+		registerBackendMetric(prommatrix)
+	}
+
+	if extractDirector != nil {
+		promunknownratio = prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "varnish_backend_unknown_director_ratio",
+				Help: "fraction of varnish backends with unknown director",
+			},
+		)
+		prometheus.MustRegister(promunknownratio)
+		prombackendsperdirector = prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "varnish_backends_per_director",
+				Help:    "number of varnish backends in each director, observed on every check",
+				Buckets: []float64{1, 2, 3, 5, 10, 20, 50, 100},
+			},
+		)
+		prometheus.MustRegister(prombackendsperdirector)
+		promdirectorlastchange = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "varnish_director_last_change_seconds",
+				Help: "time of the most recent state change of any varnish backend in each director, in unix time",
+			},
+			[]string{"director"},
+		)
+		registerBackendMetric(promdirectorlastchange)
+
+		if *directorAggregate {
+			promallstates = prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: "varnish_backend_state_all",
+					Help: "varnish backend states across all directors",
+				},
+				[]string{"state"},
+			)
+			registerBackendMetric(promallstates)
+		}
+	}
+
+	lastAdminLabels = make(map[string][]string)
+	lastBackendStates = make(map[string]string)
+	lastCurConns = make(map[string]bool)
+}
+
+/* Configuration of the web server */
+type webConfig struct {
+	listenAddress       string
+	healthListenAddress string
+	metricsPath         string
+	healthPath          string
+	readyPath           string
+	tlsConfig           *tls.Config
+	corsOrigin          string
+	routePrefix         string
+	metricsReady        bool
+}
+
+/*
+ * Load the TLS configuration for the web server. If a client CA file is
+ * given, clients must present a certificate signed by it.
+ */
+func loadTLSConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load TLS certificate: %s", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read %s: %s", clientCAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+/* Allow cross-origin requests from the given origin, including preflight */
+func corsHandler(origin string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Accept, Accept-Encoding")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+/* Return 503 until the first successful check of Varnish */
+func readyHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() {
+			http.Error(w, "Not ready.", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+/* Add the health and readiness checks to a mux */
+func healthHandlers(mux *http.ServeMux, web webConfig) {
+	mux.HandleFunc(web.routePrefix+web.healthPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Healthy.\n"))
+	})
+	mux.Handle(web.routePrefix+web.readyPath, readyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Ready.\n"))
+	})))
+}
+
+/*
+ * Webserver goroutine that only serves the health and readiness checks,
+ * for load balancers that should not have access to the metrics.
+ */
+func healthServer(web webConfig) {
+	mux := http.NewServeMux()
+	healthHandlers(mux, web)
+	server := &http.Server{
+		Addr:    web.healthListenAddress,
+		Handler: mux,
+	}
+	err := server.ListenAndServe()
+	fmt.Printf("Health check web server failed: %s\n", err)
+}
+
+/*
+ * Handler for the metrics. It compresses the response with gzip when the
+ * client accepts it, which Prometheus does.
+ */
+func metricsHandler(web webConfig) http.Handler {
+	handler := promhttp.Handler()
+	if web.metricsReady {
+		handler = readyHandler(handler)
+	}
+	if web.corsOrigin != "" {
+		handler = corsHandler(web.corsOrigin, handler)
+	}
+	return handler
+}
+
+/* Webserver goroutine that servers up the current metrics */
+func httpServer(web webConfig) {
+	metricsPath := web.routePrefix + web.metricsPath
+	http.Handle(metricsPath, metricsHandler(web))
+	healthHandlers(http.DefaultServeMux, web)
+	http.HandleFunc(web.routePrefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html>
+             <head><title>Varnishbackend Exporter</title></head>
+             <body>
+             <h1>Varnishbackend Exporter</h1>
+             <p><a href='` + metricsPath + `'>Metrics</a></p>
+             </body>
+             </html>`))
+	})
+
+	server := &http.Server{
+		Addr:      web.listenAddress,
+		TLSConfig: web.tlsConfig,
+	}
+	var err error
+	if web.tlsConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	fmt.Printf("Web server failed: %s\n", err)
+}
+
+/* Whether a listen address, such as :9133 or 0.0.0.0:9133, binds to all interfaces */
+func allInterfaces(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
+
+/*
+ * Check that none of the given HTTP paths overlap, since they would
+ * then hide each other. A path ending in / matches everything below it.
+ */
+func checkPaths(paths ...string) error {
+	for i, a := range paths {
+		for _, b := range paths[i+1:] {
+			if a == b ||
+				(strings.HasSuffix(a, "/") && strings.HasPrefix(b, a)) ||
+				(strings.HasSuffix(b, "/") && strings.HasPrefix(a, b)) {
+				return fmt.Errorf("HTTP paths %s and %s overlap", a, b)
+			}
+		}
+	}
+	return nil
+}
+
+/* Debug handler that returns the raw output of a live backend.list */
+func backendListHandler(dial dialFunc, secrets *secretFiles) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vadm, err := connectVarnishSecrets(dial, secrets.get())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer vadm.Close()
+
+		code, resp, err := vadm.Command("backend.list")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if code != 200 {
+			http.Error(w, fmt.Sprintf("Received code %d, expected 200", code), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(resp))
+	}
+}
+
+/* Lifecycle handler that removes all series for one director */
+func resetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if extractDirector == nil {
+		http.Error(w, "Not running in director mode", http.StatusBadRequest)
+		return
+	}
+	director := r.URL.Query().Get("director")
+	if director == "" {
+		http.Error(w, "Missing director", http.StatusBadRequest)
+		return
+	}
+	updateMutex.Lock()
+	n := prombackends.DeletePartialMatch(prometheus.Labels{"director": director})
+	clear(lastBackendStates)
+	updateMutex.Unlock()
+	fmt.Printf("Reset %d series for director %s\n", n, director)
+	fmt.Fprintf(w, "%d\n", n)
+}
+
+/* Set while checking of Varnish has been paused through the lifecycle endpoints */
+var paused atomic.Bool
+var prompaused prometheus.Gauge
+
+/* Lifecycle handler that pauses or resumes checking of Varnish */
+func pauseHandler(pause bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		paused.Store(pause)
+		if pause {
+			prompaused.Set(1)
+			fmt.Println("Paused checking of Varnish, serving last values")
+			w.Write([]byte("Paused.\n"))
+		} else {
+			prompaused.Set(0)
+			fmt.Println("Resumed checking of Varnish")
+			w.Write([]byte("Resumed.\n"))
+		}
+	}
+}
+
+/*
+ * Lifecycle handler returning the configuration in effect as JSON, with
+ * each flag as set on the command line or in the environment. The
+ * director regexps are the current ones, which may have been reloaded,
+ * and passwords in URLs are redacted.
+ */
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	config := make(map[string]any)
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if u, err := url.Parse(value); err == nil && u.User != nil {
+			value = u.Redacted()
+		}
+		config[f.Name] = value
+	})
+
+	directorMutex.RLock()
+	if len(directorRegexps) > 0 {
+		restrs := make([]string, len(directorRegexps))
+		for i, re := range directorRegexps {
+			restrs[i] = re.String()
+		}
+		config["directorre"] = restrs
+	}
+	directorMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(config)
+}
+
+/*
+ * Lifecycle handler that replaces the director regexps with the ones
+ * given as directorre parameters, keeping the old ones if any is invalid.
+ */
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	directorMutex.RLock()
+	regexpMode := len(directorRegexps) > 0
+	directorMutex.RUnlock()
+	if !regexpMode {
+		http.Error(w, "Not running in director regexp mode", http.StatusBadRequest)
+		return
+	}
+	restrs := r.URL.Query()["directorre"]
+	if len(restrs) == 0 {
+		http.Error(w, "Missing directorre", http.StatusBadRequest)
+		return
+	}
+	var regexps []*regexp.Regexp
+	for _, restr := range restrs {
+		re, err := regexp.Compile(restr)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid regexp: %s", err), http.StatusBadRequest)
+			return
+		}
+		regexps = append(regexps, re)
+	}
+
+	directorMutex.Lock()
+	directorRegexps = regexps
+	directorMutex.Unlock()
+
+	/* Directors may have been renamed, so start over on next check */
+	updateMutex.Lock()
+	prombackends.Reset()
+	clear(lastBackendStates)
+	updateMutex.Unlock()
+	fmt.Printf("Reloaded director regexps: %s\n", strings.Join(restrs, ", "))
+	w.Write([]byte("Reloaded.\n"))
+}
+
+/*
+ * Check if a response indicates that the Varnish child process is not
+ * running, which is what we see while it is being restarted.
+ */
+func childRestarting(code int, resp *string) bool {
+	if code == 400 {
+		return true
+	}
+	return code == 300 && resp != nil && strings.Contains(strings.ToLower(*resp), "child not running")
+}
+
+/* The states that backends are counted in */
+func backendStates() []string {
+	states := []string{"healthy", "sick"}
+	if !*countAdminDisabled {
+		states = append(states, "maintenance")
+	}
+	if *unprobedState {
+		states = append(states, "unprobed")
+	}
+	return states
+}
+
+/* A backend as listed by backend.list */
+type backendInfo struct {
+	name         string
+	admin        string
+	probed       bool
+	probeHealthy bool
+}
+
+/*
+ * Parse the fields of a line from backend.list. Varnish 7 lists the
+ * probe result as e.g. "5/5" followed by a separate "healthy" or "sick"
+ * column, which is detected from the header. Older versions list it as
+ * e.g. "Healthy 5/5" in the probe column. Some versions leave out the
+ * probe column completely when there are no probes, which is also
+ * detected from the header.
+ */
+func parseBackend(fields []string, v7 bool, probed bool) (backendInfo, bool) {
+	if !probed {
+		if len(fields) < 2 {
+			return backendInfo{}, false
+		}
+		return backendInfo{name: fields[0], admin: fields[1], probed: false}, true
+	}
+	if v7 {
+		if len(fields) < 4 {
+			return backendInfo{}, false
+		}
+		return backendInfo{name: fields[0], admin: fields[1], probed: true, probeHealthy: fields[3] == "healthy"}, true
+	}
+	if len(fields) < 3 {
+		return backendInfo{}, false
+	}
+	return backendInfo{name: fields[0], admin: fields[1], probed: true, probeHealthy: fields[2] == "Healthy"}, true
+}
+
+/*
+ * Check if a line is the header of backend.list. The spacing and columns
+ * differ between versions, so only the leading words "Backend name" are
+ * matched. Also returns whether the header has the separate Health
+ * column of Varnish 7.
+ */
+func parseHeader(line string) (bool, bool) {
+	if len(line) < 7 || !strings.EqualFold(line[:7], "backend") {
+		return false, false
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 || !strings.EqualFold(fields[0], "backend") || !strings.EqualFold(fields[1], "name") {
+		return false, false
+	}
+	for _, f := range fields[2:] {
+		if strings.EqualFold(f, "health") {
+			return true, true
+		}
+	}
+	return true, false
+}
+
+/* Position of a column in the backend.list header, or -1 if it isn't there */
+func headerColumn(header string, name string) int {
+	i := 0
+	for i < len(header) {
+		for i < len(header) && (header[i] == ' ' || header[i] == '\t') {
+			i++
+		}
+		start := i
+		for i < len(header) && header[i] != ' ' && header[i] != '\t' {
+			i++
+		}
+		if start < i && strings.EqualFold(header[start:i], name) {
+			return start
+		}
+	}
+	return -1
+}
+
+/*
+ * Get the field in a line at the position of a column in the header, and
+ * which field number it is. The columns are aligned, but the value may
+ * start a bit before the header if it is right aligned.
+ */
+func columnField(line string, column int) (int, string, bool) {
+	if column >= len(line) {
+		return 0, "", false
+	}
+	for column > 0 && line[column-1] != ' ' && line[column-1] != '\t' {
+		column--
+	}
+	var field [1]string
+	if splitFields(line[column:], field[:]) == 0 {
+		return 0, "", false
+	}
+	var before [8]string
+	return splitFields(line[:column], before[:]), field[0], true
+}
+
+/*
+ * Get the rest of a line from the position of a column in the header,
+ * for the last column, whose value may contain spaces.
+ */
+func columnRest(line string, column int) string {
+	if column >= len(line) {
+		return ""
+	}
+	for column > 0 && line[column-1] != ' ' && line[column-1] != '\t' {
+		column--
+	}
+	return strings.TrimSpace(line[column:])
+}
+
+/*
+ * Split a line into whitespace separated fields like strings.Fields, but
+ * into the given slice instead of allocating a new one. Fields beyond
+ * the length of the slice are ignored. Returns the number of fields.
+ *
+ * Whitespace within double quotes doesn't split, so that backend names
+ * with spaces can be quoted. The quotes are removed from a field that
+ * is quoted as a whole, such as "my backend 1".
+ */
+func splitFields(line string, fields []string) int {
+	n := 0
+	for n < len(fields) {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			break
+		}
+		end := 0
+		quoted := false
+		for end < len(line) && (quoted || (line[end] != ' ' && line[end] != '\t')) {
+			if line[end] == '"' {
+				quoted = !quoted
+			}
+			end++
+		}
+		field := line[:end]
+		if len(field) >= 2 && field[0] == '"' && field[len(field)-1] == '"' {
+			field = field[1 : len(field)-1]
+		}
+		fields[n] = field
+		line = line[end:]
+		n++
+	}
+	return n
+}
+
+/* Kinds of lines in backend.list */
+const (
+	lineHeader = iota
+	lineDetail
+	lineBackend
+	lineInvalid
+)
+
+/* A line of backend.list, with the backend parsed from it if it is one */
+type backendLine struct {
+	kind    int
+	text    string
+	backend backendInfo
+	/* Value of the current connections column, if there is one */
+	cur string
+}
+
+/*
+ * Parser of the lines of backend.list, keeping track of the columns
+ * given by the last header.
+ */
+type backendListParser struct {
+	resp string
+	v7   bool
+	/* Whether there is a probe column, assumed until a header says otherwise */
+	probed bool
+	/* Positions of the current connections and last change columns, or -1 */
+	curColumn  int
+	lastColumn int
+	fields     [5]string
+}
+
+func newBackendListParser(resp string) *backendListParser {
+	return &backendListParser{resp: resp, probed: true, curColumn: -1, lastColumn: -1}
+}
+
+/* Parse the next line, returning false at the end of the list */
+func (p *backendListParser) next() (backendLine, bool) {
+	if p.resp == "" {
+		return backendLine{}, false
+	}
+	var t string
+	if i := strings.IndexByte(p.resp, '\n'); i >= 0 {
+		t, p.resp = p.resp[:i], p.resp[i+1:]
+	} else {
+		t, p.resp = p.resp, ""
+	}
+	t = strings.TrimSuffix(t, "\r")
+	if header, health := parseHeader(t); header {
+		p.v7 = health
+		p.probed = headerColumn(t, "Probe") >= 0
+		p.curColumn = headerColumn(t, "Cur")
+		/* Called Last change in Varnish 7, and Last updated before */
+		p.lastColumn = headerColumn(t, "Last")
+		return backendLine{kind: lineHeader, text: t}, true
+	}
+	if strings.HasPrefix(t, " ") || strings.HasPrefix(t, "\t") {
+		/* Detail lines belonging to the previous backend */
+		return backendLine{kind: lineDetail, text: t}, true
+	}
+	fs := p.fields[:splitFields(t, p.fields[:])]
+	var cur string
+	if p.curColumn >= 0 {
+		/* Remove the column, so that the others are where expected */
+		if i, v, ok := columnField(t, p.curColumn); ok && i < len(fs) {
+			cur = v
+			copy(fs[i:], fs[i+1:])
+			fs = fs[:len(fs)-1]
+		}
+	}
+	b, ok := parseBackend(fs, p.v7, p.probed)
+	if !ok {
+		return backendLine{kind: lineInvalid, text: t}, true
+	}
+	return backendLine{kind: lineBackend, text: t, backend: b, cur: cur}, true
+}
+
+/*
+ * Classify a backend into one of the backend states. The admin flag
+ * healthy or sick is an override set by an operator, while auto (called
+ * probe in older versions) means that the probe decides.
+ */
+func backendState(b backendInfo) string {
+	switch b.admin {
+	case "healthy":
+		return "healthy"
+	case "sick":
+		if b.probeHealthy && !*countAdminDisabled {
+			/* Admin disabled, but probe says it's fine */
+			return "maintenance"
+		}
+		return "sick"
+	default:
+		if !b.probed && *unprobedState {
+			return "unprobed"
+		}
+		if b.probeHealthy {
+			return "healthy"
+		}
+		return "sick"
+	}
+}
+
+/* Number of labels pointing to a VCL, listed after its name by vcl.list */
+var vclLabelsRe = regexp.MustCompile(`\s+\(\d+ labels?\)\s*$`)
+
+/*
+ * Parse the output of vcl.list into the name of the active VCL and the
+ * names of all loaded VCLs. The name is the last column, followed by
+ * e.g. "(1 label)" if labels point to the VCL. Labels, listed as
+ * label -> vcl, are not VCLs of their own, and discarded VCLs are on
+ * their way out.
+ */
+func parseVCLList(resp string) (string, []string) {
+	var active string
+	var names []string
+	for _, line := range strings.Split(resp, "\n") {
+		fields := strings.Fields(vclLabelsRe.ReplaceAllString(line, ""))
+		if len(fields) < 2 {
+			continue
+		}
+		if fields[0] == "active" {
+			active = fields[len(fields)-1]
+		}
+		if fields[0] == "discarded" || slices.Contains(fields, "->") {
+			continue
+		}
+		names = append(names, fields[len(fields)-1])
+	}
+	return active, names
+}
+
+/* Count the backends in each state in the output of backend.list */
+func countBackendStates(resp string) map[string]int {
+	counts := make(map[string]int)
+	p := newBackendListParser(resp)
+	for l, ok := p.next(); ok; l, ok = p.next() {
+		if l.kind == lineBackend {
+			counts[backendState(l.backend)]++
+			counts["total"]++
+		}
+	}
+	return counts
+}
+
+/*
+ * Set the number of backends in each state for every loaded VCL, using
+ * one backend.list per VCL. This shows whether the backends of a newly
+ * loaded VCL are healthy before it is made active.
+ */
+func updateVCLBackends(vadm *VarnishWrapper) error {
+	code, resp, err := vadm.Command("vcl.list")
+	if err != nil {
+		return err
+	}
+	if code != 200 {
+		return fmt.Errorf("vcl.list returned code %d", code)
+	}
+	_, vcls := parseVCLList(resp)
+
+	counts := make(map[string]map[string]int, len(vcls))
+	for _, vcl := range vcls {
+		code, resp, err := vadm.Command("backend.list", vcl+".*")
+		if err != nil {
+			return err
+		}
+		if code != 200 {
+			return fmt.Errorf("backend.list for VCL %s returned code %d", vcl, code)
+		}
+		counts[vcl] = countBackendStates(resp)
+	}
+
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+	/* VCLs that have been discarded should disappear */
+	promvclstates.Reset()
+	for vcl, c := range counts {
+		for _, state := range append(backendStates(), "total") {
+			promvclstates.WithLabelValues(vcl, state).Set(float64(c[state]))
+		}
+	}
+	return nil
+}
+
+/* Declaration of a director object in VCL */
+var vclDirectorRe = regexp.MustCompile(`(?m)^\s*new\s+([A-Za-z0-9_-]+)\s*=\s*directors\.`)
+
+/* Get the name of the active VCL using vcl.list */
+func activeVCL(vadm *VarnishWrapper) (string, error) {
+	code, resp, err := vadm.Command("vcl.list")
+	if err != nil {
+		return "", err
+	}
+	if code != 200 {
+		return "", fmt.Errorf("vcl.list returned code %d", code)
+	}
+	active, _ := parseVCLList(resp)
+	if active == "" {
+		return "", fmt.Errorf("No active VCL found")
+	}
+	return active, nil
+}
+
+/* Get the source of a VCL using vcl.show */
+func vclSource(vadm *VarnishWrapper, vcl string) (string, error) {
+	code, resp, err := vadm.Command("vcl.show", vcl)
+	if err != nil {
+		return "", err
+	}
+	if code != 200 {
+		return "", fmt.Errorf("vcl.show returned code %d", code)
+	}
+	return resp, nil
+}
+
+/*
+ * Get the names of the directors declared in the active VCL, using
+ * vcl.list to find the active VCL and vcl.show to get its source.
+ */
+func vclDirectors(vadm *VarnishWrapper) ([]string, error) {
+	active, err := activeVCL(vadm)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := vclSource(vadm, active)
+	if err != nil {
+		return nil, err
+	}
+	var directors []string
+	for _, m := range vclDirectorRe.FindAllStringSubmatch(resp, -1) {
+		directors = append(directors, m[1])
+	}
+	return directors, nil
+}
+
+/* Start of a backend declaration in VCL, up to its opening brace */
+var vclBackendRe = regexp.MustCompile(`(?m)^\s*backend\s+([A-Za-z0-9_-]+)\s*\{`)
+
+/* The port attribute of a backend declaration */
+var vclPortRe = regexp.MustCompile(`\.port\s*=\s*"?([0-9]+)"?\s*;`)
+
+/*
+ * Get the port of each backend declared with a numeric .port in VCL
+ * source, by backend name. Nested blocks such as an inline probe are
+ * skipped, so only the attributes of the backend itself are looked at.
+ */
+func vclBackendPorts(src string) map[string]string {
+	ports := make(map[string]string)
+	for _, m := range vclBackendRe.FindAllStringSubmatchIndex(src, -1) {
+		var attrs strings.Builder
+		depth := 1
+		for i := m[1]; i < len(src) && depth > 0; i++ {
+			switch src[i] {
+			case '{':
+				depth++
+			case '}':
+				depth--
+			default:
+				if depth == 1 {
+					attrs.WriteByte(src[i])
+				}
+			}
+		}
+		if p := vclPortRe.FindStringSubmatch(attrs.String()); p != nil {
+			ports[src[m[2]:m[3]]] = p[1]
+		}
+	}
+	return ports
+}
+
+/*
+ * Ports of the backends of the active VCL for -backend.port-label, by
+ * backend name as listed by backend.list, and the VCL they were read
+ * from. A loaded VCL can't be changed, so its source is only fetched
+ * again when another VCL becomes active.
+ */
+var backendPorts struct {
+	vcl   string
+	ports map[string]string
+}
+
+/* Update the backend ports if the active VCL has changed */
+func updateBackendPorts(vadm *VarnishWrapper) error {
+	active, err := activeVCL(vadm)
+	if err != nil {
+		return err
+	}
+	if active == backendPorts.vcl {
+		return nil
+	}
+	src, err := vclSource(vadm, active)
+	if err != nil {
+		return err
+	}
+	ports := make(map[string]string)
+	for name, port := range vclBackendPorts(src) {
+		/* backend.list names the backends of a VCL vcl.backend */
+		ports[active+"."+name] = port
+	}
+	backendPorts.vcl, backendPorts.ports = active, ports
+	return nil
+}
+
+/*
+ * Set the number of backends in each director, including directors
+ * declared in VCL that currently have no backends at all.
+ */
+func updateDirectorBackends(counts map[string]map[string]int, directors []string) {
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+
+	promdirectorbackends.Reset()
+	for _, director := range directors {
+		promdirectorbackends.WithLabelValues(director).Set(0)
+	}
+	for director, c := range counts {
+		promdirectorbackends.WithLabelValues(director).Set(float64(c["total"]))
+	}
+}
+
+/*
+ * Check whether Varnish can list the backends as JSON, using
+ * backend.list -j. Versions without it reject the parameter.
+ */
+func backendListJSON(vadm *VarnishWrapper) (bool, error) {
+	code, resp, err := vadm.Command("backend.list", "-j")
+	if err != nil {
+		return false, err
+	}
+	return code == 200 && strings.HasPrefix(strings.TrimSpace(resp), "["), nil
+}
+
+/*
+ * Check for JSON support on a connection of its own, so that a failure
+ * or a slow response doesn't affect the connection used for checking.
+ */
+func probeBackendListJSON(dial dialFunc, secrets [][]byte) (bool, error) {
+	vadm, err := connectVarnishSecrets(dial, secrets)
+	if err != nil {
+		return false, err
+	}
+	defer vadm.Close()
+	return backendListJSON(vadm)
+}
+
+/*
+ * Parse the output of backend.list and update the gauges, returning the
+ * total number of backends found and the counts per director and state.
+ */
+func updateBackends(resp string) (int, map[string]map[string]int) {
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+
+	/* With thousands of backends, avoid growing the maps while parsing */
+	lines := strings.Count(resp, "\n") + 1
+
+	/* Counts per director and state, director is "" if not in director mode */
+	counts := make(map[string]map[string]int)
+	if extractDirector == nil {
+		counts[""] = make(map[string]int)
+	}
+
+	/* Only set for backends listed this time, if the column exists at all */
+	curConns := make(map[string]bool)
+
+	/* State of each backend, for the JSON snapshot */
+	states := make(map[string]string, lines)
+
+	/* Number of backends per admin flag and probe result */
+	matrix := make(map[[2]string]int)
+
+	/* Admin flag of each exported backend */
+	admins := make(map[string]string, lines)
+
+	var perbackend, overflow int
+	/* Lines that are neither backends nor their details, including the header */
+	var skipped int
+	/* The latest change per director */
+	lastChange := make(map[string]time.Time)
+	p := newBackendListParser(resp)
+	for l, ok := p.next(); ok; l, ok = p.next() {
+		switch l.kind {
+		case lineHeader:
+			skipped++
+			continue
+		case lineDetail:
+			continue
+		case lineInvalid:
+			Debug(fmt.Sprintf("Could not parse backend line: %s", l.text))
+			skipped++
+			continue
+		}
+		b, cur := l.backend, l.cur
+		/* The fields point into the response, which shouldn't be kept alive by the metrics */
+		b.name = strings.Clone(b.name)
+		b.admin = strings.Clone(b.admin)
+
+		/* Limit the number of per backend series, but count all backends */
+		if *backendMax == 0 || perbackend < *backendMax {
+			perbackend++
+			admins[b.name] = b.admin
+			if cur != "" && promcurconns != nil {
+				if n, err := strconv.ParseFloat(cur, 64); err == nil {
+					promcurconns.WithLabelValues(b.name).Set(n)
+					curConns[b.name] = true
+				}
+			}
+		} else {
+			overflow++
+		}
+
+		var lbl string
+		if extractDirector != nil {
+			lbl = extractDirector(b.name)
+		}
+		if counts[lbl] == nil {
+			counts[lbl] = make(map[string]int)
+		}
+		state := backendState(b)
+		states[b.name] = state
+		if *backendMatrix {
+			probe := "none"
+			if b.probed && b.probeHealthy {
+				probe = "healthy"
+			} else if b.probed {
+				probe = "sick"
+			}
+			matrix[[2]string{b.admin, probe}]++
+		}
+		counts[lbl][state]++
+		counts[lbl]["total"]++
+
+		if promdirectorlastchange != nil && p.lastColumn >= 0 {
+			if changed, err := http.ParseTime(columnRest(l.text, p.lastColumn)); err == nil && changed.After(lastChange[lbl]) {
+				lastChange[lbl] = changed
+			}
+		}
+	}
+	promskippedlines.Set(float64(skipped))
+	promoverflow.Set(float64(overflow))
+	for name := range lastCurConns {
+		if !curConns[name] {
+			promcurconns.DeleteLabelValues(name)
+		}
+	}
+	lastCurConns = curConns
+	if *logTransitions {
+		logStateTransitions(states)
+	}
+	storeSnapshot(counts, states)
+	lastCheck.Store(time.Now().UnixNano())
+
+	if *backendMatrix {
+		/* Combinations that no longer exist should disappear */
+		prommatrix.Reset()
+		for k, n := range matrix {
+			prommatrix.WithLabelValues(k[0], k[1]).Set(float64(n))
+		}
+	}
+
+	if promadmin != nil {
+		adminLabels := make(map[string][]string, len(admins))
+		for name, admin := range admins {
+			labels := []string{name, admin}
+			if port := backendPorts.ports[name]; *portLabel && port != "" {
+				labels = append(labels, port)
+			}
+			adminLabels[name] = labels
+			adminGauge(labels).WithLabelValues(labels...).Set(1)
+		}
+		/*
+		 * Remove backends that have been removed or changed admin flag since
+		 * last time. Resetting everything instead is expensive with thousands
+		 * of backends, since every series then has to be created again.
+		 */
+		for name, labels := range lastAdminLabels {
+			if !slices.Equal(labels, adminLabels[name]) {
+				adminGauge(labels).DeleteLabelValues(labels...)
+			}
+		}
+		lastAdminLabels = adminLabels
+	}
+
+	if *metricStyle == "enum" {
+		/*
+		 * One series per exported backend and state, 1 for its current
+		 * state. Like for the admin flag, only backends that are new,
+		 * removed or changed state are touched, since recreating every
+		 * series on each check is expensive with thousands of backends.
+		 */
+		backendLabels := func(name string, state string) prometheus.Labels {
+			labels := prometheus.Labels{"backend": name, "state": state}
+			if extractDirector != nil {
+				labels["director"] = extractDirector(name)
+			}
+			return labels
+		}
+		current := make(map[string]string, len(admins))
+		for name := range admins {
+			state := states[name]
+			current[name] = state
+			last, seen := lastBackendStates[name]
+			if seen && last == state {
+				continue
+			}
+			for _, s := range backendStates() {
+				if s == state {
+					prombackends.With(backendLabels(name, s)).Set(1)
+				} else if !seen || s == last {
+					prombackends.With(backendLabels(name, s)).Set(0)
+				}
+			}
+		}
+		for name := range lastBackendStates {
+			if _, ok := current[name]; !ok {
+				for _, s := range backendStates() {
+					prombackends.Delete(backendLabels(name, s))
+				}
+			}
+		}
+		lastBackendStates = current
+	} else {
+		/*
+		 * Always set every state for every director, including zeros, so
+		 * that series don't disappear and reappear between scans.
+		 */
+		for director, c := range counts {
+			for _, state := range append(backendStates(), "total") {
+				labels := prometheus.Labels{"state": state}
+				if extractDirector != nil {
+					labels["director"] = director
+				}
+				prombackends.With(labels).Set(float64(c[state]))
+			}
+		}
+	}
+
+	var total int
+	for _, c := range counts {
+		total += c["total"]
+	}
+
+	if promdirectorlastchange != nil {
+		/* Directors that are gone should disappear */
+		promdirectorlastchange.Reset()
+		for director, changed := range lastChange {
+			promdirectorlastchange.WithLabelValues(director).Set(float64(changed.Unix()))
+		}
+	}
+
+	if promallstates != nil {
+		/* Saves summing over directors for the global view */
+		all := make(map[string]int)
+		for _, c := range counts {
+			for state, n := range c {
+				all[state] += n
+			}
+		}
+		for _, state := range append(backendStates(), "total") {
+			promallstates.WithLabelValues(state).Set(float64(all[state]))
+		}
+	}
+
+	if extractDirector != nil {
+		for _, c := range counts {
+			prombackendsperdirector.Observe(float64(c["total"]))
+		}
+
+		if total > 0 {
+			ratio := float64(counts["unknown"]["total"]) / float64(total)
+			promunknownratio.Set(ratio)
+			if ratio > *unknownWarnRatio {
+				fmt.Printf("Warning: %d of %d backends have unknown director\n", counts["unknown"]["total"], total)
+			}
+		} else {
+			promunknownratio.Set(0)
+		}
+	}
+
+	return total, counts
+}
+
+var (
+	debug              = flag.Bool("debug", false, "Print debugging information.")
+	unknownWarnRatio   = flag.Float64("director.unknown-warn-ratio", 0.5, "Warn when more than this fraction of backends have unknown director")
+	backendMax         = flag.Int("backend.max", 0, "Maximum number of backends to export per backend series for, 0 for unlimited")
+	checkTimestamps    = flag.Bool("metric.timestamps", false, "Attach the time of the last check as timestamp to the backend metrics. Prometheus does not mark such series stale when they disappear, and drops samples too far in the past")
+	backendMatrix      = flag.Bool("backend.matrix", false, "Export the number of backends for each combination of admin flag and probe result")
+	metricStyle        = flag.String("metric.style", "count", "How to export varnish_backend_state: count for the number of backends in each state, or enum for one series per backend and state. enum adds one series per backend and state")
+	portLabel          = flag.Bool("backend.port-label", false, "Add the backend port declared in the active VCL as a port label on varnish_backend_admin, which requires the per-backend collector. Runs vcl.list on every check, and vcl.show when the active VCL changes")
+	logTransitions     = flag.Bool("log.transitions", false, "Log an event for every backend that changed state since the previous check")
+	unprobedState      = flag.Bool("unprobed-state", false, "Count backends without probe data as unprobed instead of sick")
+	connectTimeout     = flag.Int("varnish.connect-timeout", 5, "Seconds to allow for connecting and authenticating to Varnish, 0 for no timeout")
+	readBufferSize     = flag.Int("varnish.read-buffer-size", 1<<20, "Largest response from Varnish, in bytes, to keep a buffer for and reuse between commands")
+	maxResponseSize    = flag.Int("varnish.max-response-size", 16<<20, "Largest response from Varnish to accept, in bytes. A larger response fails the command")
+	commandTimeout     = flag.Int("varnish.command-timeout", 30, "Seconds to allow for each command to Varnish and its response, 0 for no timeout")
+	vclBackends        = flag.Bool("vcl.all", false, "Also export the number of backends in each state for every loaded VCL. Runs vcl.list and one backend.list per VCL on every check")
+	directorAggregate  = flag.Bool("director.aggregate", false, "In a director mode, also export the number of backends in each state across all directors")
+	countAdminDisabled = flag.Bool("count-admin-disabled", true, "Count backends disabled by admin as sick. If false, they are counted as maintenance when the probe is healthy.")
+)
+
+/* Groups of metrics without a flag of their own, enabled by -collectors */
+var exportAdmin, exportConnections bool
+
+/*
+ * Enable the groups of metrics in a comma separated list. Each group
+ * but aggregate, which is always exported, turns on the flags for it.
+ */
+func enableCollectors(list string) error {
+	collectorFlags := map[string][]*bool{
+		"aggregate":          nil,
+		"per-backend":        {&exportAdmin},
+		"connections":        {&exportConnections},
+		"matrix":             {backendMatrix},
+		"vcl":                {vclBackends},
+		"director-aggregate": {directorAggregate},
+	}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		flags, ok := collectorFlags[name]
+		if !ok {
+			return fmt.Errorf("Unknown collector: %s", name)
+		}
+		for _, f := range flags {
+			*f = true
+		}
+	}
+	return nil
+}
+
+func Debug(msg string) {
+	if *debug {
+		fmt.Println(msg)
+	}
+}
+
+/* Name of the environment variable for a flag, e.g. VBE_VARNISH_PORT */
+func flagEnvName(name string) string {
+	return "VBE_" + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+}
+
+/*
+ * Set all flags that were not given on the command line from their
+ * corresponding environment variable, if there is one.
+ */
+func flagsFromEnv() error {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] || err != nil {
+			return
+		}
+		if v, ok := os.LookupEnv(flagEnvName(f.Name)); ok {
+			if e := f.Value.Set(v); e != nil {
+				err = fmt.Errorf("Invalid value \"%s\" for %s: %s", v, flagEnvName(f.Name), e)
+			}
+		}
+	})
+	return err
+}
+
+/*
+ * Parse a saved backend.list output instead of talking to Varnish, and
+ * either print the resulting metrics or serve them until killed.
+ */
+func replay(filename string, once bool, web webConfig) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		fmt.Printf("Failed to read %s: %s\n", filename, err)
+		os.Exit(1)
+	}
+	updateBackends(string(data))
+	ready.Store(true)
+
+	if once {
+		mfs, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			fmt.Printf("Failed to gather metrics: %s\n", err)
+			os.Exit(1)
+		}
+		for _, mf := range mfs {
+			if strings.HasPrefix(mf.GetName(), "varnish_") {
+				expfmt.MetricFamilyToText(os.Stdout, mf)
+			}
+		}
+		return
+	}
+
+	httpServer(web)
+}
+
+/* Delay before reconnecting after a failure, and before retrying a push */
+const retryDelay = 5 * time.Second
+
+func main() {
+	var (
+		listenAddress       = flag.String("web.listen-address", ":9133", "Address to listen on for web interface and telemetry. Empty to disable.")
+		requireSecure       = flag.Bool("web.require-secure", false, "Refuse to start when listening on all interfaces without TLS")
+		healthListenAddress = flag.String("web.health-listen-address", "", "Additional address to serve only the health and readiness checks on, without TLS")
+		metricsPath         = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+		routePrefix         = flag.String("web.route-prefix", "", "Prefix for all web endpoints, for use behind a reverse proxy")
+		corsOrigin          = flag.String("web.cors-origin", "", "Origin to allow cross-origin requests for metrics from, * for any")
+		tlsCertFile         = flag.String("web.tls-cert-file", "", "Certificate file to enable TLS on the web server")
+		tlsKeyFile          = flag.String("web.tls-key-file", "", "Key file for -web.tls-cert-file")
+		tlsClientCAFile     = flag.String("web.tls-client-ca-file", "", "CA file to require and verify client certificates against")
+		deferUntilReady     = flag.Int("web.defer-until-ready", 0, "Only start the web server after Varnish has been checked successfully, exiting if that has not happened within this many seconds. 0 to start it immediately")
+		metricsReady        = flag.Bool("web.metrics-wait-ready", false, "Return 503 for metrics until Varnish has been checked successfully")
+		healthPath          = flag.String("web.health-path", "/-/healthy", "Path under which to expose health check.")
+		readyPath           = flag.String("web.ready-path", "/-/ready", "Path under which to expose readiness check.")
+		varnishName         = flag.String("varnish.name", "", "Name of the Varnish instance (as given to varnishd -n), added to all metrics as the instance_name label")
+		varnishHost         = flag.String("varnish.host", "localhost", "Host of Varnish to connect to")
+		varnishPort         = flag.Int("varnish.port", 6082, "Port of Varnish to connect to")
+		varnishSecret       = flag.String("varnish.secret", "/etc/varnish/secret", "Filename of varnish secret file. May be a comma separated list of files or directories, to try each secret in turn")
+		varnishSecretCmd    = flag.String("varnish.secret-cmd", "", "Command whose output is used as the Varnish secret instead of -varnish.secret, run again on every reconnect")
+		varnishAuthDigest   = flag.String("varnish.auth-digest", "sha256", "Digest to use when authenticating to Varnish")
+		secretReload        = flag.Int("varnish.secret-reload-interval", 0, "Seconds between re-reading the secret file, 0 to only read it at startup")
+		varnishProxy        = flag.String("varnish.proxy", "", "URL of HTTP proxy to connect to Varnish through using CONNECT")
+		varnishSSH          = flag.String("varnish.ssh", "", "SSH server to tunnel the connection to Varnish through, as [user@]host[:port]. -varnish.host is then resolved by the SSH server")
+		varnishSSHKey       = flag.String("varnish.ssh-key", "", "File with the private key to authenticate to the SSH server with")
+		varnishSSHKnownHost = flag.String("varnish.ssh-known-hosts", "", "Known hosts file to verify the SSH server against, by default ~/.ssh/known_hosts")
+		varnishInterval     = flag.Int("varnish.interval", 15, "Varnish checking interval")
+		directorsFromVCL    = flag.Bool("director.from-vcl", false, "Also read the directors declared in the active VCL, to export directors without backends. Runs vcl.list and vcl.show on every check")
+		regionRe            = flag.String("target.regionre", "", "Regular expression extracting a region label from -varnish.host, added to all metrics")
+		directorMode        = flag.String("director.mode", "regexp", "How to extract director name from backend name (regexp or vcl-prefix)")
+		emaFactor           = flag.Float64("scrape.latency-ema-factor", 0.1, "Smoothing factor for the moving average of scrape latency, between 0 and 1")
+		nativeBucketFactor  = flag.Float64("scrape.native-histogram-bucket-factor", 0, "Export the scrape duration as a native histogram with this bucket growth factor, above 1. 0 for classic buckets")
+		warmupInterval      = flag.Int("varnish.warmup-interval", 0, "Varnish checking interval during warm-up after connecting, 0 to disable")
+		warmupDuration      = flag.Int("varnish.warmup-duration", 30, "Seconds after connecting to use the warm-up interval")
+		checkStatus         = flag.Bool("varnish.status", false, "Check that the Varnish child is running before listing backends")
+		logScrapeSummary    = flag.Bool("log.scrape-summary", false, "Log a summary line after every check of Varnish")
+		scrapeRetries       = flag.Int("scrape.retries", 0, "Number of times to retry a failed backend.list before reconnecting")
+		scrapeDeadline      = flag.Int("scrape.deadline", 0, "Seconds to allow for a whole check, from connecting to parsing the backend list, before abandoning it, 0 for no deadline")
+		upFailureThreshold  = flag.Int("up.failure-threshold", 1, "Number of failed checks in a row before varnish_up is set to 0")
+		connMaxLifetime     = flag.Int("varnish.conn-max-lifetime", 0, "Seconds after which to reconnect to Varnish, 0 for unlimited")
+		restartGrace        = flag.Int("varnish.restart-grace", 30, "Seconds to hold last values while the Varnish child restarts")
+		pushgatewayURL      = flag.String("pushgateway.url", "", "URL of Pushgateway to push metrics to after each check")
+		pushgatewayJob      = flag.String("pushgateway.job", "varnishbackend_exporter", "Job name to use when pushing to Pushgateway")
+		pushgatewayGrouping = flag.String("pushgateway.grouping", "", "Grouping labels to use when pushing to Pushgateway, as name=value,name=value")
+		statsdAddress       = flag.String("statsd.address", "", "Address of statsd server to send backend counts to over UDP after each check")
+		statsdPrefix        = flag.String("statsd.prefix", "varnish.", "Prefix of the metric names sent to statsd")
+		replayFile          = flag.String("replay-file", "", "Read backend.list output from this file instead of connecting to Varnish")
+		once                = flag.Bool("once", false, "With -replay-file, print the metrics and exit instead of serving them")
+		requireBackends     = flag.Int("require-backends", 0, "Log an error if no backends have been found after this many checks, 0 to disable")
+		requireBackendsExit = flag.Bool("require-backends.exit", false, "Exit instead of just logging when -require-backends triggers")
+		enableDebug         = flag.Bool("web.enable-debug", false, "Enable the /debug/backend-list endpoint.")
+		enableLifecycle     = flag.Bool("web.enable-lifecycle", false, "Enable the /admin endpoints.")
+		enableSnapshot      = flag.Bool("web.enable-snapshot", false, "Enable the /snapshot.json endpoint.")
+		collectors          = flag.String("collectors", "aggregate", "Comma separated list of groups of metrics to export: aggregate, per-backend, connections, matrix, vcl and director-aggregate. aggregate is always exported")
+		checkConfig         = flag.Bool("check-config", false, "Check the configuration and exit, without listening or connecting to Varnish")
+		showVersion         = flag.Bool("version", false, "Print version information.")
+	)
+	var directorReStrs stringsFlag
+	flag.Var(&directorReStrs, "directorre", "Regular expression extracting director name from backend name. May be given multiple times, tried in order")
+	var metricHelp stringsFlag
+	flag.Var(&metricHelp, "metric.help", "Help text to use for a metric, as name=text. May be given multiple times")
+	flag.Parse()
+	if err := flagsFromEnv(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if *showVersion {
+		fmt.Println(version.Print("varnishbackend_exporter"))
+		os.Exit(0)
+	}
+
+	if err := enableCollectors(*collectors); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *portLabel && !exportAdmin {
+		fmt.Println("-backend.port-label requires the per-backend collector")
+		os.Exit(1)
+	}
+
+	if *emaFactor <= 0 || *emaFactor > 1 {
+		fmt.Printf("Invalid smoothing factor: %g\n", *emaFactor)
+		os.Exit(1)
+	}
+
+	if *nativeBucketFactor != 0 && *nativeBucketFactor <= 1 {
+		fmt.Printf("Invalid native histogram bucket factor: %g\n", *nativeBucketFactor)
+		os.Exit(1)
+	}
+
+	if d, ok := authDigests[*varnishAuthDigest]; ok {
+		authDigest = d
+	} else {
+		fmt.Printf("Invalid authentication digest: %s\n", *varnishAuthDigest)
+		os.Exit(1)
+	}
+
+	if *varnishPort < 1 || *varnishPort > 65535 {
+		fmt.Printf("Invalid Varnish port: %d\n", *varnishPort)
+		os.Exit(1)
+	}
 
-	headers, err := fmt.Fscanf(v.conn, "%03d %8d\n", &status, &length)
-	if err != nil {
-		fmt.Printf("Failed to scan header: %s\n", err)
-		return -1, nil
+	paths := []string{*metricsPath, *healthPath, *readyPath}
+	if *enableDebug {
+		paths = append(paths, "/debug/backend-list")
+	}
+	if *enableLifecycle {
+		paths = append(paths, "/admin/reset", "/admin/reload", "/admin/pause", "/admin/resume", "/admin/config")
+	}
+	if *enableSnapshot {
+		paths = append(paths, "/snapshot.json")
+	}
+	if err := checkPaths(paths...); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
 
-	if headers != 2 {
-		fmt.Printf("Invalid number of headers: %d\n", headers)
-		return -1, nil
+	web := webConfig{
+		listenAddress:       *listenAddress,
+		healthListenAddress: *healthListenAddress,
+		metricsPath:         *metricsPath,
+		healthPath:          *healthPath,
+		readyPath:           *readyPath,
+		corsOrigin:          *corsOrigin,
+		metricsReady:        *metricsReady,
+	}
+	if prefix := strings.Trim(*routePrefix, "/"); prefix != "" {
+		/* Always of the form /prefix, without a trailing slash */
+		web.routePrefix = "/" + prefix
+	}
+	if *tlsCertFile != "" {
+		tlsConfig, err := loadTLSConfig(*tlsCertFile, *tlsKeyFile, *tlsClientCAFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		web.tlsConfig = tlsConfig
+	} else if *tlsClientCAFile != "" {
+		fmt.Println("Client certificates require -web.tls-cert-file")
+		os.Exit(1)
+	}
+	if allInterfaces(web.listenAddress) && web.tlsConfig == nil {
+		if *requireSecure {
+			fmt.Printf("Listening on all interfaces at %s without TLS, refusing to start because of -web.require-secure\n", web.listenAddress)
+			os.Exit(1)
+		}
+		fmt.Printf("WARNING: Listening on all interfaces at %s without TLS, metrics can be read by anyone who can reach this host\n", web.listenAddress)
 	}
 
-	buf := make([]byte, length+1)
-	l, err := v.conn.Read(buf)
-	if err != nil {
-		fmt.Printf("Read from Varnish failed: %s\n", err)
-		return -1, nil
+	switch *directorMode {
+	case "regexp":
+		for _, r := range directorReStrs {
+			re, err := regexp.Compile(r)
+			if err != nil {
+				fmt.Printf("Invalid director regexp \"%s\": %s\n", r, err)
+				os.Exit(1)
+			}
+			directorRegexps = append(directorRegexps, re)
+		}
+		if len(directorRegexps) > 0 {
+			extractDirector = regexpDirector
+		}
+	case "vcl-prefix":
+		extractDirector = prefixDirector
+	default:
+		fmt.Printf("Invalid director mode: %s\n", *directorMode)
+		os.Exit(1)
 	}
 
-	if l != length+1 {
-		fmt.Printf("Read %d, expected %d\n", l, length+1)
-		return -1, nil
+	if *directorsFromVCL && extractDirector == nil {
+		fmt.Println("-director.from-vcl requires a director mode")
+		os.Exit(1)
+	}
+	if *directorAggregate && extractDirector == nil {
+		fmt.Println("-director.aggregate requires a director mode")
+		os.Exit(1)
 	}
 
-	ret := string(buf[0 : len(buf)-1])
-	return status, &ret
-}
+	if *metricStyle != "count" && *metricStyle != "enum" {
+		fmt.Printf("Invalid metric style: %s\n", *metricStyle)
+		os.Exit(1)
+	}
 
-func (v *VarnishWrapper) Send(str string, args ...string) error {
-	var buf = append([]string{str}, args...)
-	body := fmt.Sprintf("%s\n", strings.Join(buf, " "))
-	_, err := v.conn.Write([]byte(body))
-	if err != nil {
-		fmt.Printf("Write error: %s\n", err)
-		return err
+	if len(metricHelp) > 0 {
+		help := make(map[string]string)
+		for _, h := range metricHelp {
+			kv := strings.SplitN(h, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				fmt.Printf("Invalid metric help: %s\n", h)
+				os.Exit(1)
+			}
+			help[kv[0]] = kv[1]
+		}
+		prometheus.DefaultGatherer = helpGatherer{prometheus.DefaultGatherer, help}
 	}
-	return nil
-}
+	prometheus.DefaultGatherer = lockedGatherer{prometheus.DefaultGatherer}
 
-func (v *VarnishWrapper) CommandForSuccess(cmd string, args ...string) bool {
-	err := v.Send(cmd, args...)
-	if err != nil {
-		return false
+	/* Labels added to all metrics */
+	constLabels := prometheus.Labels{}
+	if *regionRe != "" {
+		re, err := regexp.Compile(*regionRe)
+		if err != nil {
+			fmt.Printf("Invalid region regexp \"%s\": %s\n", *regionRe, err)
+			os.Exit(1)
+		}
+		if m := re.FindStringSubmatch(*varnishHost); len(m) > 1 && m[1] != "" {
+			constLabels["region"] = m[1]
+		} else {
+			fmt.Printf("Region regexp does not match %s, not adding region label\n", *varnishHost)
+		}
+	}
+	if *varnishName != "" {
+		constLabels["instance_name"] = *varnishName
+	}
+	if len(constLabels) > 0 {
+		/* Adds the labels to everything registered from here on */
+		prometheus.DefaultRegisterer = prometheus.WrapRegistererWith(constLabels, prometheus.DefaultRegisterer)
 	}
-	code, _ := v.ReadResponse()
-	return (code == 200)
-}
 
-/* Prometheus counters */
-var prombackends *prometheus.GaugeVec
+	registerBackendMetrics()
+	promreadbytes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "varnish_backend_conn_read_bytes_total",
+			Help: "bytes read from the varnish management interface",
+		},
+	)
+	prometheus.MustRegister(promreadbytes)
+	promwritebytes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "varnish_backend_conn_write_bytes_total",
+			Help: "bytes written to the varnish management interface",
+		},
+	)
+	prometheus.MustRegister(promwritebytes)
 
-var directorRegexp *regexp.Regexp = nil
-var promlabels []string
+	promauthsuccesses = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "varnish_backend_auth_success_total",
+			Help: "successful authentications to varnish",
+		},
+	)
+	prometheus.MustRegister(promauthsuccesses)
+	promauthfailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "varnish_backend_auth_failure_total",
+			Help: "failed authentications to varnish",
+		},
+		[]string{"reason"},
+	)
+	prometheus.MustRegister(promauthfailures)
+	for _, reason := range []string{"no_challenge", "malformed_challenge", "wrong_secret", "error"} {
+		promauthfailures.WithLabelValues(reason)
+	}
 
-/* Webserver goroutine that servers up the current metrics */
-func httpServer(listenAddress string, metricsPath string) {
-	http.Handle(metricsPath, promhttp.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-             <head><title>Varnishbackend Exporter</title></head>
-             <body>
-             <h1>Varnishbackend Exporter</h1>
-             <p><a href='` + metricsPath + `'>Metrics</a></p>
-             </body>
-             </html>`))
-	})
-	http.ListenAndServe(listenAddress, nil)
-}
+	prominterval := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "varnish_backend_scrape_interval_seconds",
+			Help: "configured interval between varnish checks",
+		},
+	)
+	prometheus.MustRegister(prominterval)
+	prominterval.Set(float64(*varnishInterval))
 
-var (
-	debug = flag.Bool("debug", false, "Print debugging information.")
-)
+	prombehind := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "varnish_backend_scrape_behind_total",
+			Help: "checks of varnish that took longer than the checking interval",
+		},
+	)
+	prometheus.MustRegister(prombehind)
 
-func Debug(msg string) {
-	if *debug {
-		fmt.Println(msg)
+	/* Without classic buckets given, a bucket factor gives a native only histogram */
+	promduration := prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:                        "varnish_backend_scrape_duration_seconds",
+			Help:                        "time taken to get and parse the backend list from varnish",
+			NativeHistogramBucketFactor: *nativeBucketFactor,
+		},
+	)
+	prometheus.MustRegister(promduration)
+	promconnectduration := prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name: "varnish_backend_connect_duration_seconds",
+			Help: "time taken to connect and authenticate to varnish",
+		},
+	)
+	prometheus.MustRegister(promconnectduration)
+	promlastsuccess := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "varnish_backend_last_successful_command_timestamp_seconds",
+			Help: "time of the last successful command to varnish",
+		},
+	)
+	prometheus.MustRegister(promlastsuccess)
+	promlastcount := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "varnish_backend_last_scrape_count",
+			Help: "number of varnish backends in the last successful check",
+		},
+	)
+	prometheus.MustRegister(promlastcount)
+	var promchild prometheus.Gauge
+	if *checkStatus {
+		promchild = prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "varnish_child_running",
+				Help: "whether the varnish child process is running",
+			},
+		)
+		prometheus.MustRegister(promchild)
 	}
-}
 
-func main() {
-	var (
-		listenAddress   = flag.String("web.listen-address", ":9133", "Address to listen on for web interface and telemetry.")
-		metricsPath     = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
-		varnishPort     = flag.Int("varnish.port", 6082, "Port of Varnish to connect to")
-		varnishSecret   = flag.String("varnish.secret", "/etc/varnish/secret", "Filename of varnish secret file")
-		varnishInterval = flag.Int("varnish.interval", 15, "Varnish checking interval")
-		directorReStr   = flag.String("directorre", "", "Regular expression extracting director name from backend name")
-		showVersion     = flag.Bool("version", false, "Print version information.")
+	promup := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "varnish_up",
+			Help: "whether the last checks of varnish were successful",
+		},
 	)
-	flag.Parse()
+	prometheus.MustRegister(promup)
+	promfailures := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "varnish_backend_consecutive_failures",
+			Help: "number of failed checks of varnish in a row",
+		},
+	)
+	prometheus.MustRegister(promfailures)
 
-	if *showVersion {
-		fmt.Println(version.Print("varnishbackend_exporter"))
-		os.Exit(0)
+	promscrapeerrors := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "varnish_backend_scrape_errors_total",
+			Help: "failed checks of varnish by phase of the check",
+		},
+		[]string{"phase"},
+	)
+	prometheus.MustRegister(promscrapeerrors)
+	for _, phase := range []string{"dial", "auth", "command", "timeout", "deadline"} {
+		promscrapeerrors.WithLabelValues(phase)
 	}
 
-	if *directorReStr != "" {
-		directorRegexp = regexp.MustCompile(*directorReStr)
-		promlabels = []string{"state", "director"}
-	} else {
-		promlabels = []string{"state"}
+	prombackoff := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "varnish_backend_current_backoff_seconds",
+			Help: "delay before the current attempt to reconnect to varnish",
+		},
+	)
+	prometheus.MustRegister(prombackoff)
+
+	promiterations := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "varnish_backend_exporter_loop_iterations_total",
+			Help: "iterations of the loop checking varnish, whether varnish could be reached or not",
+		},
+	)
+	prometheus.MustRegister(promiterations)
+
+	if *vclBackends {
+		promvclstates = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "varnish_backend_vcl_state",
+				Help: "varnish backend states in each loaded vcl",
+			},
+			[]string{"vcl", "state"},
+		)
+		registerBackendMetric(promvclstates)
 	}
 
-	secret, err := ioutil.ReadFile(*varnishSecret)
-	if err != nil {
-		fmt.Printf("Failed to read %s: %s\n", *varnishSecret, err)
+	promjson := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "varnish_backend_json_supported",
+			Help: "whether the running varnish supports backend.list -j, -1 until it has been checked",
+		},
+	)
+	promjson.Set(-1)
+	prometheus.MustRegister(promjson)
+
+	promcommands := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "varnish_backend_commands_per_scrape",
+			Help: "management commands sent to varnish in the last successful check",
+		},
+	)
+	prometheus.MustRegister(promcommands)
+
+	promdeadline := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "varnish_backend_scrape_deadline_exceeded_total",
+			Help: "checks of varnish abandoned for exceeding -scrape.deadline",
+		},
+	)
+	prometheus.MustRegister(promdeadline)
+
+	promskipped := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "varnish_backend_skipped_scrapes_total",
+			Help: "checks of varnish abandoned to reconnect",
+		},
+	)
+	prometheus.MustRegister(promskipped)
+	promlatencyema := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "varnish_backend_scrape_latency_ema_seconds",
+			Help: "exponential moving average of time taken to get and parse the backend list from varnish",
+		},
+	)
+	prometheus.MustRegister(promlatencyema)
+
+	if *directorsFromVCL {
+		promdirectorbackends = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "varnish_director_backends",
+				Help: "number of varnish backends in each director, including directors in vcl without backends",
+			},
+			[]string{"director"},
+		)
+		prometheus.MustRegister(promdirectorbackends)
+	}
+
+	if *enableLifecycle {
+		prompaused = prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "varnish_backend_scraping_paused",
+				Help: "whether checking of varnish has been paused",
+			},
+		)
+		prometheus.MustRegister(prompaused)
+	}
+
+	if *replayFile != "" {
+		if *checkConfig {
+			if _, err := ioutil.ReadFile(*replayFile); err != nil {
+				fmt.Printf("Failed to read %s: %s\n", *replayFile, err)
+				os.Exit(1)
+			}
+			fmt.Println("Configuration OK")
+			os.Exit(0)
+		}
+		replay(*replayFile, *once, web)
+		return
+	}
+
+	secrets := &secretFiles{paths: strings.Split(*varnishSecret, ","), cmd: *varnishSecretCmd}
+	if err := secrets.load(); err != nil {
+		if secrets.cmd != "" {
+			fmt.Printf("Failed to get secret: %s\n", err)
+		} else {
+			fmt.Printf("Failed to read %s: %s\n", *varnishSecret, err)
+		}
 		os.Exit(1)
 	}
+	if secrets.cmd == "" {
+		prometheus.MustRegister(newSecretAgeCollector(secrets))
+	}
 
-	prombackends = prometheus.NewGaugeVec(
+	var pusher *push.Pusher
+	if *pushgatewayURL != "" {
+		pusher = push.New(*pushgatewayURL, *pushgatewayJob).Collector(prombackends)
+		for _, g := range strings.Split(*pushgatewayGrouping, ",") {
+			if g == "" {
+				continue
+			}
+			kv := strings.SplitN(g, "=", 2)
+			if len(kv) != 2 {
+				fmt.Printf("Invalid grouping label: %s\n", g)
+				os.Exit(1)
+			}
+			pusher = pusher.Grouping(kv[0], kv[1])
+		}
+		for name, value := range constLabels {
+			pusher = pusher.Grouping(name, value)
+		}
+	}
+
+	var statsd *statsdClient
+	if *statsdAddress != "" {
+		var err error
+		statsd, err = newStatsdClient(*statsdAddress, *statsdPrefix)
+		if err != nil {
+			fmt.Printf("Could not set up statsd: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	/* Where we connect, as shown in log messages */
+	var target string
+	var dial dialFunc
+	varnishAddr := hostPort(*varnishHost, *varnishPort)
+	if *varnishSSH != "" {
+		if *varnishProxy != "" {
+			fmt.Println("-varnish.ssh and -varnish.proxy can't be combined")
+			os.Exit(1)
+		}
+		tunnel, err := newSSHTunnel(*varnishSSH, *varnishSSHKey, *varnishSSHKnownHost, time.Duration(*connectTimeout)*time.Second)
+		if err != nil {
+			fmt.Printf("Could not set up SSH tunnel: %s\n", err)
+			os.Exit(1)
+		}
+		target = fmt.Sprintf("%s via SSH %s", varnishAddr, tunnel.addr)
+		dial = func() (net.Conn, error) {
+			return tunnel.dial(varnishAddr)
+		}
+	} else if *varnishProxy != "" {
+		proxyURL, err := url.Parse(*varnishProxy)
+		if err != nil {
+			fmt.Printf("Could not parse proxy URL: %s\n", err)
+			os.Exit(1)
+		}
+		proxyAddr, err := proxyAddress(proxyURL)
+		if err != nil {
+			fmt.Printf("Invalid proxy URL: %s\n", err)
+			os.Exit(1)
+		}
+		target = fmt.Sprintf("%s via proxy %s", varnishAddr, proxyAddr)
+		dial = func() (net.Conn, error) {
+			return dialProxy(proxyURL, varnishAddr, time.Duration(*connectTimeout)*time.Second)
+		}
+	} else {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", varnishAddr)
+		if err != nil {
+			fmt.Printf("Could not resolve address: %s\n", err)
+			os.Exit(1)
+		}
+		target = tcpAddr.String()
+		dial = directDial(tcpAddr.String(), time.Duration(*connectTimeout)*time.Second)
+	}
+
+	promtarget := prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Name: "varnish_backend_state",
-			Help: "varnish backend states",
+			Name: "varnish_backend_target_info",
+			Help: "varnish instance checked by this exporter",
 		},
-		promlabels,
+		[]string{"host", "port"},
 	)
-	prometheus.MustRegister(prombackends)
+	prometheus.MustRegister(promtarget)
+	promtarget.WithLabelValues(*varnishHost, strconv.Itoa(*varnishPort)).Set(1)
+
+	if *checkConfig {
+		/* Everything has been validated, so don't actually start */
+		fmt.Println("Configuration OK")
+		os.Exit(0)
+	}
+
+	if *enableDebug {
+		http.HandleFunc(web.routePrefix+"/debug/backend-list", backendListHandler(dial, secrets))
+	}
+	if *enableSnapshot {
+		http.HandleFunc(web.routePrefix+"/snapshot.json", snapshotHandler)
+	}
+	if *enableLifecycle {
+		http.HandleFunc(web.routePrefix+"/admin/reset", resetHandler)
+		http.HandleFunc(web.routePrefix+"/admin/reload", reloadHandler)
+		http.HandleFunc(web.routePrefix+"/admin/pause", pauseHandler(true))
+		http.HandleFunc(web.routePrefix+"/admin/resume", pauseHandler(false))
+		http.HandleFunc(web.routePrefix+"/admin/config", configHandler)
+	}
+
+	if *secretReload > 0 {
+		go secrets.reload(time.Duration(*secretReload) * time.Second)
+	}
+
+	if *healthListenAddress != "" {
+		go healthServer(web)
+	}
 
 	// Http listener
-	go httpServer(*listenAddress, *metricsPath)
+	startServer := *listenAddress != ""
+	if startServer && *deferUntilReady > 0 {
+		/* Only start listening once Varnish has been checked */
+		time.AfterFunc(time.Duration(*deferUntilReady)*time.Second, func() {
+			if !ready.Load() {
+				fmt.Printf("Varnish could not be checked within %d seconds, exiting\n", *deferUntilReady)
+				os.Exit(1)
+			}
+		})
+	} else if startServer {
+		go httpServer(web)
+		startServer = false
+	}
 
-	// Main loop to poll Varnish
-	tcpAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("localhost:%d", *varnishPort))
-	if err != nil {
-		fmt.Printf("Could not resolve address: %s\n", err)
-		os.Exit(1)
+	/*
+	 * Only report Varnish as down after a number of failures in a row,
+	 * so a single transient failure doesn't page anyone.
+	 */
+	var failures int
+	var deadline cycleDeadline
+	failed := func(err error) {
+		if deadline.stop() {
+			promdeadline.Inc()
+			err = newScrapeError("deadline", fmt.Errorf("Check did not finish within %d seconds: %w", *scrapeDeadline, err))
+		}
+		phase := "command"
+		var serr *ScrapeError
+		if errors.As(err, &serr) {
+			phase = serr.Phase
+		}
+		promscrapeerrors.WithLabelValues(phase).Inc()
+		fmt.Printf("Failed to check Varnish at %s (%s): %s\n", target, phase, err)
+
+		failures++
+		promfailures.Set(float64(failures))
+		if failures >= *upFailureThreshold {
+			promup.Set(0)
+		}
 	}
 
+	// Main loop to poll Varnish
+	var restarted time.Time
+	var latencyEMA float64
+	var checks int
+	var seenBackends bool
+	var jsonChecked bool
+	/* No pushing before this, after a failed push */
+	var nextPush time.Time
 	first := true
 	for {
+		/* Stops increasing only if the loop itself is stuck */
+		promiterations.Inc()
+		if paused.Load() {
+			Debug("Checking is paused, not connecting to Varnish")
+			time.Sleep(time.Second)
+			/* Connect right away when resumed */
+			first = true
+			continue
+		}
+
 		/* To make sure we don't flood things */
 		if first {
 			first = false
+			prombackoff.Set(0)
 		} else {
 			/* Rate limit */
-			Debug("Sleeping 5 seconds before connecting")
-			time.Sleep(5 * time.Second)
+			prombackoff.Set(retryDelay.Seconds())
+			Debug(fmt.Sprintf("Sleeping %s before connecting", retryDelay))
+			time.Sleep(retryDelay)
 		}
-		Debug("Connecting to Varnish")
-		conn, err := net.DialTCP("tcp", nil, tcpAddr)
-		if err != nil {
-			fmt.Printf("Connection failed: %s\n", err.Error())
-			continue
+		Debug(fmt.Sprintf("Connecting to Varnish at %s", target))
+		if secrets.cmd != "" {
+			/* Fetch it again, in case it's short-lived */
+			if err := secrets.load(); err != nil {
+				failed(newScrapeError("auth", err))
+				continue
+			}
 		}
-		defer conn.Close()
-		vadm := &VarnishWrapper{conn: conn}
-		code, resp := vadm.ReadResponse()
-		if code != 107 {
-			fmt.Println("Varnish did not give authentication prompt.")
+		connectStart := time.Now()
+		deadline.start(time.Duration(*scrapeDeadline) * time.Second)
+		vadm, err := connectVarnishSecrets(deadline.dial(dial), secrets.get())
+		if err != nil {
+			failed(err)
 			continue
 		}
-		challenge := strings.Split(*resp, "\n")[0]
-		response := sha256.Sum256([]byte(fmt.Sprintf("%s\n%s%s\n", challenge, secret, challenge)))
-		if !vadm.CommandForSuccess("auth", hex.EncodeToString(response[:])) {
-			fmt.Println("Failed to authenticate")
-			continue
+		promconnectduration.Observe(time.Since(connectStart).Seconds())
+		Debug(fmt.Sprintf("Connected to Varnish at %s", target))
+		connected := time.Now()
+		prombackoff.Set(0)
+
+		/* Only checked once, and tried again on the next connection if that fails */
+		if !jsonChecked {
+			supported, err := probeBackendListJSON(dial, secrets.get())
+			if err != nil {
+				fmt.Printf("Could not check for JSON support: %s\n", err)
+			} else if supported {
+				fmt.Println("Varnish supports backend.list -j, which gives output that is more robust to parse")
+				promjson.Set(1)
+				jsonChecked = true
+			} else {
+				Debug("Varnish does not support backend.list -j, parsing text output")
+				promjson.Set(0)
+				jsonChecked = true
+			}
 		}
 
 		/*
@@ -187,72 +2745,197 @@ func main() {
 		 * connection for multiple commands.
 		 */
 		for {
+			promiterations.Inc()
+			if paused.Load() {
+				Debug("Checking is paused, disconnecting from Varnish")
+				break
+			}
+
+			if *connMaxLifetime > 0 && time.Since(connected) > time.Duration(*connMaxLifetime)*time.Second {
+				Debug("Connection reached maximum lifetime, reconnecting")
+				/* No need to rate limit a planned reconnect */
+				first = true
+				break
+			}
+
+			deadline.start(time.Duration(*scrapeDeadline) * time.Second)
+			vadm.commands = 0
+			if *checkStatus {
+				code, resp, err := vadm.Command("status")
+				if err != nil {
+					promskipped.Inc()
+					failed(newScrapeError("command", err))
+					break
+				}
+				if code != 200 {
+					promskipped.Inc()
+					failed(newScrapeError("command", fmt.Errorf("Failed to get child status, code %d: %s", code, resp)))
+					break
+				}
+				promlastsuccess.SetToCurrentTime()
+				if !strings.Contains(resp, "state running") {
+					/* The backend list is meaningless without a child */
+					promchild.Set(0)
+					Debug(fmt.Sprintf("Varnish child is not running (%s), skipping backend list", strings.TrimSpace(resp)))
+					deadline.stop()
+					time.Sleep(time.Duration(*varnishInterval) * time.Second)
+					continue
+				}
+				promchild.Set(1)
+			}
+
 			Debug("Getting list from Varnish")
+			scrapeStart := time.Now()
+			if *portLabel {
+				if err := updateBackendPorts(vadm); err != nil {
+					fmt.Printf("Failed to get backend ports from VCL: %s\n", err)
+				}
+			}
 			err := vadm.Send("backend.list")
 			if err != nil {
+				promskipped.Inc()
+				failed(newScrapeError("command", err))
 				break
 			}
 
 			code, resp := vadm.ReadResponse()
-			if code != 200 {
-				fmt.Printf("Received code %d, expected 200\n", code)
+			/*
+			 * Retry a failed backend.list on the same connection before
+			 * giving up on it. A failed read leaves the connection in an
+			 * unknown state, so that always reconnects.
+			 */
+			for retry := 0; retry < *scrapeRetries && code > 0 && code != 200 && !childRestarting(code, resp); retry++ {
+				Debug(fmt.Sprintf("Received code %d, retrying backend.list", code))
+				time.Sleep(time.Second)
+				if vadm.Send("backend.list") != nil {
+					break
+				}
+				code, resp = vadm.ReadResponse()
+			}
+			if childRestarting(code, resp) {
+				if restarted.IsZero() {
+					fmt.Println("Varnish child is restarting, holding last values")
+					restarted = time.Now()
+				} else if time.Since(restarted) > time.Duration(*restartGrace)*time.Second {
+					promskipped.Inc()
+					failed(newScrapeError("command", fmt.Errorf("Varnish child did not come back within grace period")))
+					break
+				}
+				deadline.stop()
+				time.Sleep(time.Duration(*varnishInterval) * time.Second)
+				continue
+			}
+			if code == -1 {
+				promskipped.Inc()
+				failed(newScrapeError("command", fmt.Errorf("Failed to read backend list: %w", vadm.err)))
 				break
 			}
-			scanner := bufio.NewScanner(strings.NewReader(*resp))
-			var healthy, sick int
-			var labelhealthy, labelsick, labelall map[string]int
-			if directorRegexp != nil {
-				labelhealthy = make(map[string]int)
-				labelsick = make(map[string]int)
-				labelall = make(map[string]int)
-			} else {
-				healthy = 0
-				sick = 0
+			if code != 200 {
+				promskipped.Inc()
+				failed(newScrapeError("command", fmt.Errorf("Received code %d, expected 200", code)))
+				break
 			}
-
-			for scanner.Scan() {
-				t := scanner.Text()
-				if strings.HasPrefix(t, "Backend name ") {
-					continue
+			promlastsuccess.SetToCurrentTime()
+			if restarted.IsZero() || time.Since(restarted) > time.Duration(*restartGrace)*time.Second {
+				restarted = time.Time{}
+				n, counts := updateBackends(*resp)
+				if statsd != nil {
+					if err := statsd.sendCounts(counts); err != nil {
+						fmt.Printf("Failed to send to statsd: %s\n", err)
+					}
+				}
+				if startServer {
+					go httpServer(web)
+					startServer = false
 				}
-				fields := strings.Fields(t)
-
-				if directorRegexp != nil {
-					var lbl string
-					m := directorRegexp.FindStringSubmatch(fields[0])
-					if m != nil && len(m) > 1 {
-						lbl = m[1]
-					} else {
-						lbl = "unknown"
+				if *directorsFromVCL {
+					directors, err := vclDirectors(vadm)
+					if err != nil {
+						fmt.Printf("Failed to get directors from VCL: %s\n", err)
 					}
-					labelall[lbl] = 1
-					if fields[1] != "sick" && fields[2] == "Healthy" {
-						labelhealthy[lbl]++
-					} else {
-						labelsick[lbl]++
+					updateDirectorBackends(counts, directors)
+				}
+				if *vclBackends {
+					if err := updateVCLBackends(vadm); err != nil {
+						fmt.Printf("Failed to get backends per VCL: %s\n", err)
+					}
+				}
+				ready.Store(true)
+				failures = 0
+				promfailures.Set(0)
+				promup.Set(1)
+
+				promlastcount.Set(float64(n))
+				promcommands.Set(float64(vadm.commands))
+				if n > 0 {
+					seenBackends = true
+				}
+				checks++
+				if *requireBackends > 0 && !seenBackends && checks == *requireBackends {
+					fmt.Printf("ERROR: No backends found in %d checks, is this the right Varnish instance?\n", checks)
+					if *requireBackendsExit {
+						os.Exit(1)
 					}
+				}
+
+				duration := time.Since(scrapeStart).Seconds()
+				promduration.Observe(duration)
+				if latencyEMA == 0 {
+					latencyEMA = duration
 				} else {
-					if fields[1] != "sick" && fields[2] == "Healthy" {
-						healthy++
-					} else {
-						sick++
+					latencyEMA = *emaFactor*duration + (1-*emaFactor)*latencyEMA
+				}
+				promlatencyema.Set(latencyEMA)
+
+				/* Checking back to back would hammer the management interface */
+				if duration > float64(*varnishInterval) {
+					prombehind.Inc()
+					fmt.Printf("WARNING: Checking Varnish took %.3f seconds, longer than the interval of %d seconds, consider increasing -varnish.interval\n", duration, *varnishInterval)
+				}
+
+				if *logScrapeSummary {
+					var healthy, sick, directors int
+					for _, c := range counts {
+						healthy += c["healthy"]
+						sick += c["sick"]
+					}
+					if extractDirector != nil {
+						directors = len(counts)
 					}
+					fmt.Printf("Checked Varnish at %s: %d healthy, %d sick, %d directors in %.3f seconds\n", target, healthy, sick, directors, duration)
 				}
-			}
-			if directorRegexp != nil {
-				for k := range labelall {
-					prombackends.With(prometheus.Labels{"state": "healthy", "director": k}).Set(float64(labelhealthy[k]))
-					prombackends.With(prometheus.Labels{"state": "sick", "director": k}).Set(float64(labelsick[k]))
+
+				if pusher != nil && !time.Now().Before(nextPush) {
+					if err := pusher.Push(); err != nil {
+						/*
+						 * Retry after the same delay as a failed scrape,
+						 * but keep checking Varnish meanwhile.
+						 */
+						fmt.Printf("Failed to push to Pushgateway, retrying in %s: %s\n", retryDelay, err)
+						nextPush = time.Now().Add(retryDelay)
+					}
 				}
 			} else {
-				prombackends.With(prometheus.Labels{"state": "healthy"}).Set(float64(healthy))
-				prombackends.With(prometheus.Labels{"state": "sick"}).Set(float64(sick))
+				Debug("Varnish child restarted recently, holding last values")
+			}
+
+			if deadline.exceeded() {
+				promskipped.Inc()
+				failed(errors.New("Backend list was not parsed in time"))
+				break
 			}
+			deadline.stop()
 
-			Debug(fmt.Sprintf("Sleeping for %d seconds.", *varnishInterval))
-			time.Sleep(time.Duration(*varnishInterval) * time.Second)
+			/* Check more often for a while after (re)connecting */
+			interval := *varnishInterval
+			if *warmupInterval > 0 && time.Since(connected) < time.Duration(*warmupDuration)*time.Second {
+				interval = *warmupInterval
+			}
+			Debug(fmt.Sprintf("Sleeping for %d seconds.", interval))
+			time.Sleep(time.Duration(interval) * time.Second)
 		}
 
-		conn.Close()
+		deadline.stop()
+		vadm.Close()
 	}
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+/*
+ * Address of a listener that never accepts, with its accept queue
+ * filled up. Linux then drops new connection attempts without
+ * answering, so connecting to it hangs regardless of routing.
+ */
+func fullListener(t *testing.T) string {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Listen(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", sa.(*syscall.SockaddrInet4).Port)
+
+	for i := 0; i < 16; i++ {
+		conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+		if err != nil {
+			return addr
+		}
+		t.Cleanup(func() { conn.Close() })
+	}
+	t.Fatalf("Accept queue of %s never filled up", addr)
+	return ""
+}
+
+/* A connection that is never answered fails in the dial, after the connect timeout */
+func TestConnectTimeout(t *testing.T) {
+	addr := fullListener(t)
+	start := time.Now()
+	_, err := connectVarnish(directDial(addr, 200*time.Millisecond), []byte("secret\n"))
+	elapsed := time.Since(start)
+
+	var serr *ScrapeError
+	if !errors.As(err, &serr) || serr.Phase != "timeout" {
+		t.Fatalf("Got %v, want a timeout", err)
+	}
+	var operr *net.OpError
+	if !errors.As(err, &operr) || operr.Op != "dial" {
+		t.Errorf("Got %v, want it to come from the dial", err)
+	}
+	if elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Took %s to fail, want the 200ms connect timeout", elapsed)
+	}
+}
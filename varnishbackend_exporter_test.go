@@ -0,0 +1,1048 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"maps"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var update = flag.Bool("update", false, "Update the expected output in testdata")
+
+/* Metrics updated while connecting, registered by main */
+func init() {
+	promreadbytes = prometheus.NewCounter(prometheus.CounterOpts{Name: "varnish_backend_conn_read_bytes_total"})
+	promwritebytes = prometheus.NewCounter(prometheus.CounterOpts{Name: "varnish_backend_conn_write_bytes_total"})
+	promauthsuccesses = prometheus.NewCounter(prometheus.CounterOpts{Name: "varnish_backend_auth_success_total"})
+	promauthfailures = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "varnish_backend_auth_failure_total"}, []string{"reason"})
+}
+
+/* Set flags for the duration of a test */
+func setFlags(t testing.TB, flags map[string]string) {
+	for name, value := range flags {
+		f := flag.Lookup(name)
+		if f == nil {
+			t.Fatalf("No flag %s", name)
+		}
+		old := f.Value.String()
+		if err := f.Value.Set(value); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Value.Set(old) })
+	}
+}
+
+/* Enable groups of metrics, as with -collectors, for the duration of a test */
+func setCollectors(t testing.TB, list string) {
+	admin, connections := exportAdmin, exportConnections
+	flags := make(map[string]string)
+	for _, name := range []string{"backend.matrix", "vcl.all", "director.aggregate"} {
+		flags[name] = flag.Lookup(name).Value.String()
+	}
+	setFlags(t, flags)
+	t.Cleanup(func() { exportAdmin, exportConnections = admin, connections })
+	if err := enableCollectors(list); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/* Use the director regexps for the duration of a test */
+func setDirectorRegexps(t testing.TB, res ...string) {
+	directorRegexps = nil
+	for _, r := range res {
+		directorRegexps = append(directorRegexps, regexp.MustCompile(r))
+	}
+	extractDirector = regexpDirector
+	t.Cleanup(func() {
+		directorRegexps = nil
+		extractDirector = nil
+	})
+}
+
+/*
+ * Register the metrics updated from the backend list in a registry of
+ * their own, used as the default for the duration of a test.
+ */
+func newTestRegistry(t testing.TB) *prometheus.Registry {
+	reg := prometheus.NewPedanticRegistry()
+	registerer, gatherer := prometheus.DefaultRegisterer, prometheus.DefaultGatherer
+	prometheus.DefaultRegisterer, prometheus.DefaultGatherer = reg, reg
+	t.Cleanup(func() {
+		prometheus.DefaultRegisterer, prometheus.DefaultGatherer = registerer, gatherer
+		promunknownratio, prombackendsperdirector, promdirectorlastchange = nil, nil, nil
+		promallstates, prommatrix = nil, nil
+		promadmin, promadminnoport, promcurconns = nil, nil, nil
+	})
+	registerBackendMetrics()
+	return reg
+}
+
+/*
+ * Get the value of the series of a metric with exactly the given labels,
+ * and whether it exists.
+ */
+func metricValue(t testing.TB, reg prometheus.Gatherer, name string, labels map[string]string) (float64, bool) {
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range mf.GetMetric() {
+			if len(m.GetLabel()) != len(labels) {
+				continue
+			}
+			for _, l := range m.GetLabel() {
+				if v, ok := labels[l.GetName()]; !ok || v != l.GetValue() {
+					continue metrics
+				}
+			}
+			switch {
+			case m.Gauge != nil:
+				return m.GetGauge().GetValue(), true
+			case m.Counter != nil:
+				return m.GetCounter().GetValue(), true
+			}
+		}
+	}
+	return 0, false
+}
+
+/* Get the value of a counter not registered anywhere */
+func counterValue(c prometheus.Counter) float64 {
+	var m dto.Metric
+	c.Write(&m)
+	return m.GetCounter().GetValue()
+}
+
+/* Get the metrics of a registry like a scrape of /metrics */
+func scrape(t testing.TB, reg prometheus.Gatherer) string {
+	handler := promhttp.HandlerFor(lockedGatherer{reg}, promhttp.HandlerOpts{})
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != 200 {
+		t.Fatalf("Scrape returned code %d: %s", rec.Code, rec.Body.String())
+	}
+	return rec.Body.String()
+}
+
+func readTestdata(t testing.TB, name string) string {
+	b, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+/* Compare with the expected output in testdata, or update it with -update */
+func checkGolden(t testing.TB, name string, got string) {
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	if want := readTestdata(t, name); got != want {
+		t.Errorf("Metrics differ from %s, got:\n%s", path, got)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	tests := []struct {
+		name       string
+		flags      map[string]string
+		directors  []string
+		collectors string
+	}{
+		{"count", nil, nil, "aggregate"},
+		{"enum", map[string]string{"metric.style": "enum"}, nil, "aggregate,per-backend"},
+		{"director", nil, []string{`_(site[A-Z])$`}, "aggregate,per-backend,director-aggregate"},
+	}
+	list := readTestdata(t, "backend-list.txt")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t, tt.flags)
+			setCollectors(t, tt.collectors)
+			if tt.directors != nil {
+				setDirectorRegexps(t, tt.directors...)
+			}
+			reg := newTestRegistry(t)
+			updateBackends(list)
+			checkGolden(t, "metrics-"+tt.name+".txt", scrape(t, reg))
+		})
+	}
+}
+
+/* The same backends as listed by Varnish 7 give the same metrics */
+func TestMetricsVarnish7(t *testing.T) {
+	reg := newTestRegistry(t)
+	updateBackends(readTestdata(t, "backend-list-v7.txt"))
+	if got, want := scrape(t, reg), readTestdata(t, "metrics-count.txt"); got != want {
+		t.Errorf("Metrics differ from the older format, got:\n%s", got)
+	}
+}
+
+func TestAllHealthyDirector(t *testing.T) {
+	setDirectorRegexps(t, `_(site[A-Z])$`)
+	reg := newTestRegistry(t)
+	list := `Backend name                   Admin      Probe
+boot.web1_siteA                probe      Healthy 5/5
+boot.web2_siteA                probe      Healthy 5/5
+boot.web1_siteB                probe      Sick 0/5
+`
+	/* The series must be there on every check, not just some */
+	for i := 0; i < 20; i++ {
+		updateBackends(list)
+		for state, want := range map[string]float64{"healthy": 2, "sick": 0, "total": 2} {
+			v, ok := metricValue(t, reg, "varnish_backend_state", map[string]string{"director": "siteA", "state": state})
+			if !ok {
+				t.Fatalf("No %s series for siteA on check %d", state, i)
+			}
+			if v != want {
+				t.Errorf("siteA %s = %v, want %v", state, v, want)
+			}
+		}
+	}
+}
+
+/*
+ * Connection returning one chunk of data per read, as if sent by Varnish,
+ * and keeping what is written to it.
+ */
+type chunkConn struct {
+	net.Conn
+	chunks []string
+	sent   []string
+}
+
+func (c *chunkConn) Read(b []byte) (int, error) {
+	if len(c.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, c.chunks[0])
+	if c.chunks[0] = c.chunks[0][n:]; c.chunks[0] == "" {
+		c.chunks = c.chunks[1:]
+	}
+	return n, nil
+}
+
+func (c *chunkConn) Write(b []byte) (int, error) {
+	c.sent = append(c.sent, string(b))
+	return len(b), nil
+}
+
+func (c *chunkConn) Close() error {
+	return nil
+}
+
+func (c *chunkConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+/* Header of a response from Varnish */
+func responseHeader(code int, body string) string {
+	return fmt.Sprintf("%-3d %-8d\n", code, len(body))
+}
+
+/* Connection giving the responses to commands, in order */
+func responseConn(bodies ...string) *chunkConn {
+	c := &chunkConn{}
+	for _, body := range bodies {
+		c.chunks = append(c.chunks, responseHeader(200, body)+body+"\n")
+	}
+	return c
+}
+
+/* vcl.list of Varnish 6 and later, with labels */
+const vclListLabels = `available   auto/cold          0 old
+active      auto/warm          0 boot (2 labels)
+available  label/warm          0 prod -> boot
+available  label/warm          0 live -> boot
+`
+
+func TestReadResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+	}{
+		{"newline", []string{responseHeader(200, "hello") + "hello\n", responseHeader(200, "bye") + "bye\n"}},
+		{"no newline", []string{responseHeader(200, "hello") + "hello", responseHeader(200, "bye") + "bye"}},
+		{"late newline", []string{responseHeader(200, "hello") + "hello", "\n" + responseHeader(200, "bye") + "bye\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newVarnishWrapper(&chunkConn{chunks: tt.chunks})
+			for _, want := range []string{"hello", "bye"} {
+				code, resp := v.ReadResponse()
+				if code != 200 || resp == nil || *resp != want {
+					t.Fatalf("Got %d %v, want 200 %q (%v)", code, resp, want, v.err)
+				}
+			}
+		})
+	}
+}
+
+func TestBackendState(t *testing.T) {
+	tests := []struct {
+		admin        string
+		probed       bool
+		probeHealthy bool
+		want         string
+	}{
+		{"auto", true, true, "healthy"},
+		{"auto", true, false, "sick"},
+		{"probe", true, true, "healthy"},
+		{"probe", true, false, "sick"},
+		{"healthy", true, true, "healthy"},
+		{"healthy", true, false, "healthy"},
+		{"sick", true, true, "sick"},
+		{"sick", true, false, "sick"},
+		{"healthy", false, false, "healthy"},
+		{"sick", false, false, "sick"},
+		{"auto", false, false, "sick"},
+	}
+	for _, tt := range tests {
+		b := backendInfo{name: "boot.a", admin: tt.admin, probed: tt.probed, probeHealthy: tt.probeHealthy}
+		if got := backendState(b); got != tt.want {
+			t.Errorf("Admin %s, probed %v, probe healthy %v: got %s, want %s", tt.admin, tt.probed, tt.probeHealthy, got, tt.want)
+		}
+	}
+
+	/* Admin disabled backends with a healthy probe, and backends without probe */
+	setFlags(t, map[string]string{"count-admin-disabled": "false", "unprobed-state": "true"})
+	for _, tt := range []struct {
+		b    backendInfo
+		want string
+	}{
+		{backendInfo{admin: "sick", probed: true, probeHealthy: true}, "maintenance"},
+		{backendInfo{admin: "sick", probed: true, probeHealthy: false}, "sick"},
+		{backendInfo{admin: "auto", probed: false}, "unprobed"},
+		{backendInfo{admin: "healthy", probed: false}, "healthy"},
+	} {
+		if got := backendState(tt.b); got != tt.want {
+			t.Errorf("%+v: got %s, want %s", tt.b, got, tt.want)
+		}
+	}
+}
+
+/*
+ * The response varnishadm sends, SHA-256 of the challenge, a newline,
+ * the secret file as is, the challenge and a newline, computed with
+ * sha256sum.
+ */
+func TestAuthResponse(t *testing.T) {
+	challenge := "abcdefghijklmnopqrstuvwxyzabcdef"
+	tests := []struct {
+		secret string
+		want   string
+	}{
+		{"secret\n", "4612dbda0cbd8dcf32665ded74ada5fb344bbaea6f2e41ad9a99688eab0784f4"},
+		{"secret", "ab9f82d8007a815ecd0c7e748ed04d2215568f812ec4c7444411d3637e714ad6"},
+	}
+	for _, tt := range tests {
+		if got := authResponse(challenge, []byte(tt.secret)); got != tt.want {
+			t.Errorf("Secret %q: got %s, want %s", tt.secret, got, tt.want)
+		}
+	}
+}
+
+func TestBackendMax(t *testing.T) {
+	setFlags(t, map[string]string{"backend.max": "4"})
+	setCollectors(t, "per-backend")
+	reg := newTestRegistry(t)
+	list := readTestdata(t, "backend-list.txt")
+	/* The same backends left out on every check are not counted again */
+	for i := 0; i < 3; i++ {
+		updateBackends(list)
+	}
+	if v, _ := metricValue(t, reg, "varnish_backend_overflow", nil); v != 2 {
+		t.Errorf("Overflow = %v, want 2", v)
+	}
+	if v, _ := metricValue(t, reg, "varnish_backend_state", map[string]string{"state": "total"}); v != 6 {
+		t.Errorf("Total = %v, want 6", v)
+	}
+	if _, ok := metricValue(t, reg, "varnish_backend_admin", map[string]string{"backend": "boot.web5_siteB", "flag": "probe"}); ok {
+		t.Errorf("Backend above -backend.max exported")
+	}
+
+	updateBackends(`Backend name                   Admin      Probe
+boot.a                         probe      Healthy 5/5
+`)
+	if v, _ := metricValue(t, reg, "varnish_backend_overflow", nil); v != 0 {
+		t.Errorf("Overflow = %v after backends removed, want 0", v)
+	}
+}
+
+/* Listen on a local port, serving each connection with serve */
+func listen(t testing.TB, serve func(conn net.Conn)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+/* A connection closed right away is a failed connection, not an auth failure */
+func TestConnectClosed(t *testing.T) {
+	addr := listen(t, func(conn net.Conn) { conn.Close() })
+	start := time.Now()
+	_, err := connectVarnish(directDial(addr, time.Second), []byte("secret\n"))
+	var serr *ScrapeError
+	if !errors.As(err, &serr) || serr.Phase != "dial" {
+		t.Fatalf("Got %v, want a dial error", err)
+	}
+	if !strings.Contains(err.Error(), "closed before authentication prompt") {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Took %s to notice the closed connection", time.Since(start))
+	}
+}
+
+func TestHostPort(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"localhost", "localhost:6082"},
+		{"192.0.2.1", "192.0.2.1:6082"},
+		{"2001:db8::1", "[2001:db8::1]:6082"},
+		{"fe80::1%eth0", "[fe80::1%eth0]:6082"},
+		{"[fe80::1%eth0]", "[fe80::1%eth0]:6082"},
+	}
+	for _, tt := range tests {
+		if got := hostPort(tt.host, 6082); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.host, got, tt.want)
+		}
+	}
+
+	/* The zone is kept when the address is resolved */
+	addr, err := net.ResolveTCPAddr("tcp", hostPort("fe80::1%lo", 6082))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.Zone != "lo" || addr.String() != "[fe80::1%lo]:6082" {
+		t.Errorf("Resolved to %s with zone %q", addr, addr.Zone)
+	}
+}
+
+/* Lists without a probe column, when no probes are configured */
+func TestUnprobed(t *testing.T) {
+	setFlags(t, map[string]string{"unprobed-state": "true"})
+	reg := newTestRegistry(t)
+	updateBackends(`Backend name                   Admin      Last updated
+boot.a                         probe      Wed, 15 Oct 2026 10:00:00 GMT
+boot.b                         auto       Wed, 15 Oct 2026 10:00:00 GMT
+boot.c                         sick       Wed, 15 Oct 2026 10:00:00 GMT
+boot.d                         healthy    Wed, 15 Oct 2026 10:00:00 GMT
+`)
+	for state, want := range map[string]float64{"unprobed": 2, "sick": 1, "healthy": 1, "total": 4} {
+		if v, _ := metricValue(t, reg, "varnish_backend_state", map[string]string{"state": state}); v != want {
+			t.Errorf("%s = %v, want %v", state, v, want)
+		}
+	}
+
+	/* With a probe column, backends are never unprobed */
+	updateBackends(readTestdata(t, "backend-list.txt"))
+	if v, _ := metricValue(t, reg, "varnish_backend_state", map[string]string{"state": "unprobed"}); v != 0 {
+		t.Errorf("unprobed = %v with probes, want 0", v)
+	}
+}
+
+func TestPortLabel(t *testing.T) {
+	setFlags(t, map[string]string{"backend.port-label": "true"})
+	setCollectors(t, "per-backend")
+	reg := newTestRegistry(t)
+	t.Cleanup(func() { backendPorts.vcl, backendPorts.ports = "", nil })
+
+	conn := responseConn(vclListLabels, `vcl 4.1;
+backend a {
+	.host = "10.0.0.1";
+	.probe = { .url = "/"; .interval = 5s; }
+	.port = "8080";
+}
+backend b { .host = "10.0.0.2"; }
+`, vclListLabels)
+	vadm := newVarnishWrapper(conn)
+	if err := updateBackendPorts(vadm); err != nil {
+		t.Fatal(err)
+	}
+	updateBackends(`Backend name                   Admin      Probe
+boot.a                         probe      Healthy 5/5
+boot.b                         probe      Healthy 5/5
+`)
+	if _, ok := metricValue(t, reg, "varnish_backend_admin", map[string]string{"backend": "boot.a", "flag": "probe", "port": "8080"}); !ok {
+		t.Errorf("No series with port for boot.a")
+	}
+	if _, ok := metricValue(t, reg, "varnish_backend_admin", map[string]string{"backend": "boot.b", "flag": "probe"}); !ok {
+		t.Errorf("No series without port for boot.b")
+	}
+	if strings.Contains(scrape(t, reg), `port=""`) {
+		t.Errorf("Empty port label exported")
+	}
+
+	/* The source is only fetched again when another VCL is active */
+	if err := updateBackendPorts(vadm); err != nil {
+		t.Fatal(err)
+	}
+	if len(conn.sent) != 3 || conn.sent[1] != "vcl.show boot\n" {
+		t.Errorf("Sent %q, want vcl.show boot once", conn.sent)
+	}
+
+	/* The port moves from one backend to the other */
+	backendPorts.ports = map[string]string{"boot.b": "8081"}
+	updateBackends(`Backend name                   Admin      Probe
+boot.a                         probe      Healthy 5/5
+boot.b                         probe      Healthy 5/5
+`)
+	for _, labels := range []map[string]string{
+		{"backend": "boot.a", "flag": "probe"},
+		{"backend": "boot.b", "flag": "probe", "port": "8081"},
+	} {
+		if _, ok := metricValue(t, reg, "varnish_backend_admin", labels); !ok {
+			t.Errorf("No series %v", labels)
+		}
+	}
+	for _, labels := range []map[string]string{
+		{"backend": "boot.a", "flag": "probe", "port": "8080"},
+		{"backend": "boot.b", "flag": "probe"},
+	} {
+		if _, ok := metricValue(t, reg, "varnish_backend_admin", labels); ok {
+			t.Errorf("Old series %v still exported", labels)
+		}
+	}
+}
+
+func TestVCLBackendPorts(t *testing.T) {
+	ports := vclBackendPorts(`vcl 4.1;
+# backend commented { .port = "1"; }
+backend web1 {
+	.host = "web1.example";
+	.port = "8080";
+}
+backend web2 {
+	.host = "web2.example";
+	.probe = {
+		.request = "GET / HTTP/1.1";
+	}
+	.port = 8081;
+}
+backend named { .host = "named.example"; .port = "http"; }
+backend noport { .host = "noport.example"; }
+backend uds { .path = "/run/app.sock"; }
+`)
+	want := map[string]string{"web1": "8080", "web2": "8081"}
+	if !maps.Equal(ports, want) {
+		t.Errorf("Got %v, want %v", ports, want)
+	}
+}
+
+func TestDirectorCounts(t *testing.T) {
+	setDirectorRegexps(t, `^boot\.([a-z]+)_`)
+	reg := newTestRegistry(t)
+	updateBackends(`Backend name                   Admin      Probe
+boot.mixed_1                   probe      Healthy 5/5
+boot.mixed_2                   probe      Sick 0/5
+boot.mixed_3                   probe      Healthy 3/5
+boot.sick_1                    probe      Sick 0/5
+boot.sick_2                    sick       Healthy 5/5
+boot.healthy_1                 probe      Healthy 5/5
+boot.healthy_2                 healthy    Sick 0/5
+boot.healthy_3                 probe      Healthy 5/5
+`)
+	want := map[string]map[string]float64{
+		"mixed":   {"healthy": 2, "sick": 1, "total": 3},
+		"sick":    {"healthy": 0, "sick": 2, "total": 2},
+		"healthy": {"healthy": 3, "sick": 0, "total": 3},
+	}
+	for director, states := range want {
+		for state, n := range states {
+			v, ok := metricValue(t, reg, "varnish_backend_state", map[string]string{"director": director, "state": state})
+			if !ok || v != n {
+				t.Errorf("Director %s %s = %v (exists %v), want %v", director, state, v, ok, n)
+			}
+		}
+	}
+}
+
+/* A match where the capture group is empty or didn't take part falls through to the next regexp */
+func TestRegexpDirectorEmptyGroup(t *testing.T) {
+	setDirectorRegexps(t, `^boot\.(?:([a-z]+)_|x)`, `^boot\.()y`, `_([a-z]+)$`)
+	for name, want := range map[string]string{
+		"boot.web_1":     "web",
+		"boot.x1_siteA":  "unknown",
+		"boot.x1_sitea":  "sitea",
+		"boot.y1_sitea":  "sitea",
+		"boot.unmatched": "unknown",
+	} {
+		if got := regexpDirector(name); got != want {
+			t.Errorf("Director of %s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+/* The digest used by default is SHA-256, checked with the FIPS 180-2 vector */
+func TestDefaultAuthDigest(t *testing.T) {
+	for _, digest := range []func() hash.Hash{authDigest, authDigests["sha256"]} {
+		h := digest()
+		h.Write([]byte("abc"))
+		if got, want := fmt.Sprintf("%x", h.Sum(nil)), "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"; got != want {
+			t.Errorf("Got %s, want %s", got, want)
+		}
+	}
+}
+
+/* Every failed read says why, and a successful one clears the error */
+func TestReadResponseError(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+	}{
+		{"eof", nil},
+		{"bad header", []string{"hello\n"}},
+		{"short body", []string{responseHeader(200, "hello") + "hel"}},
+		{"no newline after body", []string{responseHeader(200, "hello") + "hello!\n"}},
+		{"negative length", []string{"200 -1      \n"}},
+		{"length above the limit", []string{"200 99999999\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newVarnishWrapper(&chunkConn{chunks: tt.chunks})
+			_, _, err := v.Command("ping")
+			if err == nil || v.err == nil {
+				t.Fatalf("No error")
+			}
+			if strings.Contains(err.Error(), "%!") {
+				t.Errorf("Malformed error: %s", err)
+			}
+		})
+	}
+
+	v := newVarnishWrapper(&chunkConn{chunks: []string{"bad\n", responseHeader(200, "PONG") + "PONG\n"}})
+	v.ReadResponse()
+	if code, _ := v.ReadResponse(); code != 200 || v.err != nil {
+		t.Errorf("Got %d with error %v after a good response", code, v.err)
+	}
+}
+
+/* A backend list with thousands of backends, like from a generated VCL */
+func largeBackendList(n int) string {
+	var b strings.Builder
+	b.WriteString("Backend name                   Admin      Probe                Last updated\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "boot.web%d_site%d               probe      Healthy 5/5          Wed, 15 Oct 2026 10:00:00 GMT\n", i, i%20)
+	}
+	return b.String()
+}
+
+func BenchmarkUpdateBackends(b *testing.B) {
+	setDirectorRegexps(b, `_(site[0-9]+)$`)
+	newTestRegistry(b)
+	list := largeBackendList(5000)
+	b.ReportAllocs()
+	for b.Loop() {
+		updateBackends(list)
+	}
+}
+
+func TestVCLDirectors(t *testing.T) {
+	conn := responseConn(vclListLabels, `vcl 4.1;
+import directors;
+sub vcl_init {
+	new siteA = directors.round_robin();
+	new siteB = directors.fallback();
+}
+`)
+	directors, err := vclDirectors(newVarnishWrapper(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conn.sent) != 2 || conn.sent[1] != "vcl.show boot\n" {
+		t.Errorf("Sent %q, want vcl.show boot", conn.sent)
+	}
+	if strings.Join(directors, ",") != "siteA,siteB" {
+		t.Errorf("Got directors %v", directors)
+	}
+}
+
+func TestMetricsGzip(t *testing.T) {
+	newTestRegistry(t)
+	updateBackends(readTestdata(t, "backend-list.txt"))
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	metricsHandler(webConfig{}).ServeHTTP(rec, req)
+	if enc := rec.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Content-Encoding %q, want gzip", enc)
+	}
+	r, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), `varnish_backend_state{state="total"} 6`) {
+		t.Errorf("Metrics missing from the decompressed response:\n%s", body)
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	tests := []struct {
+		version string
+		line    string
+		header  bool
+		health  bool
+	}{
+		{"4.0", "Backend name                   Refs   Admin      Probe", true, false},
+		{"4.1", "Backend name                   Admin      Probe", true, false},
+		{"6.0", "Backend name                   Admin      Probe                Last updated", true, false},
+		{"6.0 current connections", "Backend name                   Admin      Cur  Probe                Last updated", true, false},
+		{"7.0", "Backend name                   Admin      Probe    Health     Last change", true, true},
+		{"tabs", "Backend name\tAdmin\tProbe", true, false},
+		{"backend", "boot.default                   probe      Healthy 5/5", false, false},
+		{"backend named backend", "backend                        probe      Healthy 5/5", false, false},
+		{"backend named backend_name", "backend_name                   probe      Healthy 5/5", false, false},
+	}
+	for _, tt := range tests {
+		header, health := parseHeader(tt.line)
+		if header != tt.header || health != tt.health {
+			t.Errorf("%s: got header %v health %v, want %v %v", tt.version, header, health, tt.header, tt.health)
+		}
+		if !tt.header {
+			continue
+		}
+		/* The header is never counted as a backend */
+		counts := countBackendStates(tt.line + "\nboot.default probe Healthy 5/5\n")
+		if counts["total"] != 1 {
+			t.Errorf("%s: counted %d backends, want 1", tt.version, counts["total"])
+		}
+	}
+}
+
+/* Scrapes during updates see the metrics of one backend list or the other */
+func TestConcurrentScrape(t *testing.T) {
+	setFlags(t, map[string]string{"metric.style": "enum"})
+	setCollectors(t, "per-backend")
+	reg := newTestRegistry(t)
+	lists := []string{largeBackendList(200), readTestdata(t, "backend-list.txt")}
+	backends := []int{200, 6}
+	updateBackends(lists[0])
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			updateBackends(lists[i%2])
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		mfs, err := lockedGatherer{reg}.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, mf := range mfs {
+			var n int
+			switch mf.GetName() {
+			case "varnish_backend_admin":
+				n = len(mf.GetMetric())
+			case "varnish_backend_state":
+				for _, m := range mf.GetMetric() {
+					n += int(m.GetGauge().GetValue())
+				}
+			default:
+				continue
+			}
+			if n != backends[0] && n != backends[1] {
+				t.Fatalf("Scrape saw %d backends in %s", n, mf.GetName())
+			}
+		}
+	}
+}
+
+func TestQuotedName(t *testing.T) {
+	setCollectors(t, "per-backend,connections")
+	reg := newTestRegistry(t)
+	updateBackends(`Backend name                   Admin      Cur  Probe                Last updated
+"my backend 1"                 probe        3  Healthy 5/5          Wed, 15 Oct 2026 10:00:00 GMT
+"my backend 2"                 sick         0  Healthy 5/5          Wed, 15 Oct 2026 10:00:00 GMT
+boot.web1                      probe        1  Sick 0/5             Wed, 15 Oct 2026 10:00:00 GMT
+`)
+	for _, labels := range []map[string]string{
+		{"backend": "my backend 1", "flag": "probe"},
+		{"backend": "my backend 2", "flag": "sick"},
+		{"backend": "boot.web1", "flag": "probe"},
+	} {
+		if _, ok := metricValue(t, reg, "varnish_backend_admin", labels); !ok {
+			t.Errorf("No series %v", labels)
+		}
+	}
+	if v, _ := metricValue(t, reg, "varnish_backend_current_connections", map[string]string{"backend": "my backend 1"}); v != 3 {
+		t.Errorf("Current connections of my backend 1 = %v, want 3", v)
+	}
+	for state, want := range map[string]float64{"healthy": 1, "sick": 2, "total": 3} {
+		if v, _ := metricValue(t, reg, "varnish_backend_state", map[string]string{"state": state}); v != want {
+			t.Errorf("%s = %v, want %v", state, v, want)
+		}
+	}
+}
+
+/* A truncated banner is rejected without sending a response computed over it */
+func TestTruncatedChallenge(t *testing.T) {
+	banner := "abcdefghij\n\nAuthentication required.\n"
+	conn := &chunkConn{chunks: []string{responseHeader(107, banner) + banner + "\n"}}
+	before := counterValue(promauthfailures.WithLabelValues("malformed_challenge"))
+	_, err := connectVarnish(func() (net.Conn, error) { return conn, nil }, []byte("secret\n"))
+	var serr *ScrapeError
+	if !errors.As(err, &serr) || serr.Phase != "auth" || !strings.Contains(err.Error(), "malformed") {
+		t.Fatalf("Got %v, want a malformed challenge error", err)
+	}
+	if len(conn.sent) != 0 {
+		t.Errorf("Sent %q after a malformed challenge", conn.sent)
+	}
+	if after := counterValue(promauthfailures.WithLabelValues("malformed_challenge")); after != before+1 {
+		t.Errorf("Malformed challenge counted %v times, want 1", after-before)
+	}
+}
+
+/* Counting the backends of a VCL parses the list like a check does */
+func TestCountBackendStates(t *testing.T) {
+	newTestRegistry(t)
+	for _, list := range []string{
+		readTestdata(t, "backend-list.txt"),
+		readTestdata(t, "backend-list-v7.txt"),
+		`Backend name                   Admin      Cur  Probe                Last updated
+boot.a                         probe        3  Healthy 5/5          Wed, 01 Jan 2025 10:00:00 GMT
+boot.b                         sick        12  Healthy 5/5          Wed, 01 Jan 2025 10:00:00 GMT
+boot.c                         probe        0  Sick 0/5             Wed, 01 Jan 2025 10:00:00 GMT
+`,
+	} {
+		_, counts := updateBackends(list)
+		if got := countBackendStates(list); !maps.Equal(got, counts[""]) {
+			t.Errorf("Counted %v, a check counted %v in:\n%s", got, counts[""], list)
+		}
+	}
+}
+
+func TestProbeBackendListJSON(t *testing.T) {
+	varnish := fakeVarnish(t, "secret\n")
+	dial := func() (net.Conn, error) { return net.Dial("tcp", varnish) }
+	if supported, err := probeBackendListJSON(dial, [][]byte{[]byte("secret\n")}); err != nil || supported {
+		t.Errorf("Got %v %v, want unsupported without error", supported, err)
+	}
+
+	/* Failing to connect leaves it unknown */
+	if _, err := probeBackendListJSON(dial, [][]byte{[]byte("wrong\n")}); err == nil {
+		t.Errorf("No error with a wrong secret")
+	}
+}
+
+func TestWrongSecret(t *testing.T) {
+	varnish := fakeVarnish(t, "secret\n")
+	dial := func() (net.Conn, error) { return net.Dial("tcp", varnish) }
+
+	before := counterValue(promauthfailures.WithLabelValues("wrong_secret"))
+	_, err := connectVarnish(dial, []byte("wrong\n"))
+	var serr *ScrapeError
+	if !errors.As(err, &serr) || serr.Phase != "auth" || !strings.Contains(err.Error(), "wrong secret") {
+		t.Fatalf("Got %v, want a wrong secret error", err)
+	}
+	if after := counterValue(promauthfailures.WithLabelValues("wrong_secret")); after != before+1 {
+		t.Errorf("Wrong secret counted %v times, want 1", after-before)
+	}
+
+	/* The connection is closed, so the next secret is tried on a new one */
+	vadm, err := connectVarnishSecrets(dial, [][]byte{[]byte("wrong\n"), []byte("secret\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vadm.Close()
+}
+
+func TestParseVCLList(t *testing.T) {
+	tests := []struct {
+		version string
+		list    string
+		active  string
+		names   string
+	}{
+		{"4.0", "available       0 old\nactive          2 boot\n", "boot", "old,boot"},
+		{"4.1", "available  auto/cold          0 old\nactive     auto/warm          2 boot\ndiscarded  auto/cold          0 gone\n", "boot", "old,boot"},
+		{"6.0 labels", vclListLabels, "boot", "old,boot"},
+		{"6.0 one label", "active      auto/warm          0 boot (1 label)\navailable  label/warm          0 prod -> boot\n", "boot", "boot"},
+	}
+	for _, tt := range tests {
+		active, names := parseVCLList(tt.list)
+		if active != tt.active || strings.Join(names, ",") != tt.names {
+			t.Errorf("%s: got %s and %v, want %s and %s", tt.version, active, names, tt.active, tt.names)
+		}
+	}
+}
+
+func TestVCLBackends(t *testing.T) {
+	promvclstates = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "varnish_backend_vcl_state"}, []string{"vcl", "state"})
+	t.Cleanup(func() { promvclstates = nil })
+	conn := responseConn(vclListLabels,
+		"Backend name                   Admin      Probe\nold.web1                       probe      Sick 0/5\n",
+		"Backend name                   Admin      Probe\nboot.web1                      probe      Healthy 5/5\n")
+	if err := updateVCLBackends(newVarnishWrapper(conn)); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"vcl.list\n", "backend.list old.*\n", "backend.list boot.*\n"}
+	if !slices.Equal(conn.sent, want) {
+		t.Errorf("Sent %q, want %q", conn.sent, want)
+	}
+	var m dto.Metric
+	promvclstates.WithLabelValues("boot", "healthy").Write(&m)
+	if v := m.GetGauge().GetValue(); v != 1 {
+		t.Errorf("Healthy backends in boot = %v, want 1", v)
+	}
+}
+
+/*
+ * Only backends that are new, removed or changed have their series
+ * touched. Series that are deleted and created again would be new
+ * objects in the vector.
+ */
+func TestSeriesChurn(t *testing.T) {
+	setFlags(t, map[string]string{"metric.style": "enum"})
+	setCollectors(t, "per-backend")
+	reg := newTestRegistry(t)
+	updateBackends(`Backend name                   Admin      Probe
+boot.stable                    probe      Healthy 5/5
+boot.flapping                  probe      Healthy 5/5
+boot.removed                   probe      Healthy 5/5
+`)
+	stable := []prometheus.Labels{{"backend": "boot.stable", "state": "healthy"}, {"backend": "boot.stable", "state": "sick"}}
+	var before []prometheus.Gauge
+	for _, labels := range stable {
+		before = append(before, prombackends.With(labels))
+	}
+	admin := promadmin.WithLabelValues("boot.stable", "probe")
+
+	updateBackends(`Backend name                   Admin      Probe
+boot.stable                    probe      Healthy 5/5
+boot.flapping                  probe      Sick 0/5
+boot.added                     probe      Healthy 5/5
+`)
+	for i, labels := range stable {
+		if prombackends.With(labels) != before[i] {
+			t.Errorf("Series %v of an unchanged backend was created again", labels)
+		}
+	}
+	if promadmin.WithLabelValues("boot.stable", "probe") != admin {
+		t.Errorf("Admin series of an unchanged backend was created again")
+	}
+	for labels, want := range map[[2]string]float64{
+		{"boot.flapping", "healthy"}: 0,
+		{"boot.flapping", "sick"}:    1,
+		{"boot.added", "healthy"}:    1,
+	} {
+		if v, ok := metricValue(t, reg, "varnish_backend_state", map[string]string{"backend": labels[0], "state": labels[1]}); !ok || v != want {
+			t.Errorf("%v = %v (exists %v), want %v", labels, v, ok, want)
+		}
+	}
+	if _, ok := metricValue(t, reg, "varnish_backend_state", map[string]string{"backend": "boot.removed", "state": "healthy"}); ok {
+		t.Errorf("Removed backend still exported")
+	}
+}
+
+/* Connection returning the same data over and over */
+type loopConn struct {
+	net.Conn
+	data []byte
+	pos  int
+}
+
+func (c *loopConn) Read(b []byte) (int, error) {
+	if c.pos == len(c.data) {
+		c.pos = 0
+	}
+	n := copy(b, c.data[c.pos:])
+	c.pos += n
+	return n, nil
+}
+
+/* Reading a large backend list, with the buffer reused and without */
+func BenchmarkReadResponse(b *testing.B) {
+	body := largeBackendList(5000)
+	data := []byte(responseHeader(200, body) + body + "\n")
+	for _, size := range []string{"0", fmt.Sprint(len(body))} {
+		b.Run("buffer="+size, func(b *testing.B) {
+			setFlags(b, map[string]string{"varnish.read-buffer-size": size})
+			v := newVarnishWrapper(&loopConn{data: data})
+			b.ReportAllocs()
+			for b.Loop() {
+				if code, _ := v.ReadResponse(); code != 200 {
+					b.Fatalf("Got code %d", code)
+				}
+			}
+		})
+	}
+}
+
+func TestCollectors(t *testing.T) {
+	reg := newTestRegistry(t)
+	updateBackends(readTestdata(t, "backend-list.txt"))
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() == "varnish_backend_admin" || mf.GetName() == "varnish_backend_current_connections" {
+			t.Errorf("%s exported by default", mf.GetName())
+		}
+	}
+
+	setCollectors(t, "aggregate, connections")
+	reg = newTestRegistry(t)
+	updateBackends(`Backend name                   Admin      Cur  Probe
+boot.a                         probe        3  Healthy 5/5
+`)
+	if v, ok := metricValue(t, reg, "varnish_backend_current_connections", map[string]string{"backend": "boot.a"}); !ok || v != 3 {
+		t.Errorf("Current connections %v (exists %v), want 3", v, ok)
+	}
+	if _, ok := metricValue(t, reg, "varnish_backend_admin", map[string]string{"backend": "boot.a", "flag": "probe"}); ok {
+		t.Errorf("varnish_backend_admin exported without per-backend")
+	}
+
+	if err := enableCollectors("aggregate,probes"); err == nil {
+		t.Errorf("Unknown collector accepted")
+	}
+}